@@ -0,0 +1,43 @@
+package ApiServer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Reads are open, but anything that changes the pod or the server (the safety limits and child lock included) needs
+"Authorization: Bearer <API_TOKEN>".  Without a token set, changes are only accepted from the same machine.
+*/
+
+var (
+	errUnauthorized    = errors.New("missing or wrong api token")
+	errLocalWritesOnly = errors.New("changes are only accepted locally unless API_TOKEN is set")
+)
+
+// SetToken sets the token that requests changing anything must carry.
+func (a *ApiServer) SetToken(token string) {
+	a.token = token
+}
+
+func (a *ApiServer) authorize(ctx *gin.Context) {
+	switch ctx.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+	if a.token == "" {
+		// the peer address, X-Forwarded-For could say anything
+		ip := net.ParseIP(ctx.RemoteIP())
+		if ip == nil || !ip.IsLoopback() {
+			respondError(ctx, errLocalWritesOnly)
+		}
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(ctx.GetHeader("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		respondError(ctx, errUnauthorized)
+	}
+}
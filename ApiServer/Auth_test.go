@@ -0,0 +1,48 @@
+package ApiServer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		remote string
+		header string
+		want   int
+	}{
+		{"reads are open", "", http.MethodGet, "192.168.1.5:4000", "", http.StatusOK},
+		{"local change without a token", "", http.MethodPut, "127.0.0.1:4000", "", http.StatusOK},
+		{"remote change without a token", "", http.MethodPut, "192.168.1.5:4000", "", http.StatusForbidden},
+		{"change missing the token", "secret", http.MethodPut, "127.0.0.1:4000", "", http.StatusUnauthorized},
+		{"change with the wrong token", "secret", http.MethodDelete, "192.168.1.5:4000", "Bearer guess", http.StatusUnauthorized},
+		{"change with the token", "secret", http.MethodPost, "192.168.1.5:4000", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewApiServer(nil, 0)
+			a.SetToken(test.token)
+			a.Engine().Handle(test.method, "/test", func(ctx *gin.Context) {
+				ctx.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(test.method, "/test", nil)
+			req.RemoteAddr = test.remote
+			req.Header.Set("X-Forwarded-For", "127.0.0.1")
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			recorder := httptest.NewRecorder()
+			a.Engine().ServeHTTP(recorder, req)
+			if recorder.Code != test.want {
+				t.Errorf("got %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
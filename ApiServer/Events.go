@@ -0,0 +1,62 @@
+package ApiServer
+
+import (
+	"io"
+	"time"
+
+	"EightSleepServer/SparkServer"
+
+	"github.com/gin-gonic/gin"
+)
+
+const eventKeepAlive = 30 * time.Second
+
+// streamEvents pushes events to the client as server-sent events, named after the event type.
+// New subscribers first get the last known status of each pod they are watching.
+func (a *ApiServer) streamEvents(ctx *gin.Context, deviceId string) {
+	events, unsubscribe := a.spark.Events().Subscribe()
+	defer unsubscribe()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+
+	for _, pod := range a.spark.Pods() {
+		if deviceId != "" && pod.DeviceId() != deviceId {
+			continue
+		}
+		status := pod.LastStatus()
+		if status != nil {
+			ctx.SSEvent(string(SparkServer.EventStatus), SparkServer.Event{Type: SparkServer.EventStatus, DeviceId: pod.DeviceId(), Time: time.Now(), Data: status})
+		}
+	}
+	ctx.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-keepAlive.C:
+			_, err := w.Write([]byte(": keepalive\n\n"))
+			return err == nil
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			if deviceId != "" && event.DeviceId != deviceId {
+				return true
+			}
+			ctx.SSEvent(string(event.Type), event)
+			return true
+		}
+	})
+}
+
+func (a *ApiServer) getEvents(ctx *gin.Context) {
+	a.streamEvents(ctx, "")
+}
+
+func (a *ApiServer) getPodEvents(ctx *gin.Context) {
+	a.streamEvents(ctx, ctx.Param("pod"))
+}
@@ -0,0 +1,83 @@
+package ApiServer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"EightSleepServer/LogServer"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errLogServerDisabled = errors.New("log server not enabled")
+
+// SetLogServer enables the log endpoints.
+func (a *ApiServer) SetLogServer(logs *LogServer.LogServer) {
+	a.logs = logs
+}
+
+// batchIndex returns the log server's batch index, responding with an error if there isn't one.
+func (a *ApiServer) batchIndex(ctx *gin.Context) (*LogServer.BatchIndex, bool) {
+	if a.logs == nil || a.logs.Index() == nil {
+		respondError(ctx, errLogServerDisabled)
+		return nil, false
+	}
+	return a.logs.Index(), true
+}
+
+func (a *ApiServer) listBatches(ctx *gin.Context) {
+	index, ok := a.batchIndex(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, index.Entries(ctx.Query("device")))
+}
+
+func (a *ApiServer) listBatchGaps(ctx *gin.Context) {
+	index, ok := a.batchIndex(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, index.Gaps(ctx.Query("device")))
+}
+
+// SetLogTail enables the live log endpoint.
+func (a *ApiServer) SetLogTail(tail *LogServer.LogTail) {
+	a.tail = tail
+}
+
+// getLogTail streams the firmware's log text as server-sent "log" events, filtered by the device and contains query
+// parameters.
+func (a *ApiServer) getLogTail(ctx *gin.Context) {
+	if a.tail == nil {
+		respondError(ctx, errLogServerDisabled)
+		return
+	}
+	filter := LogServer.TailFilter{DeviceId: ctx.Query("device"), Contains: ctx.Query("contains")}
+	lines, unsubscribe := a.tail.Subscribe(filter)
+	defer unsubscribe()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-keepAlive.C:
+			_, err := w.Write([]byte(": keepalive\n\n"))
+			return err == nil
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent("log", line)
+			return true
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package ApiServer
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+/*
+Prometheus metrics are served at /metrics on the api port.  A MetricsServer serves them on a port of their own as
+well, so they stay available with the api disabled, and can be scraped without exposing the api.
+*/
+
+type MetricsServer struct {
+	port   int
+	logger *zap.Logger
+}
+
+func NewMetricsServer(port int) *MetricsServer {
+	logger, _ := zap.NewProduction()
+	return &MetricsServer{port: port, logger: logger}
+}
+
+// Handler serves /metrics and nothing else.
+func (m *MetricsServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func (m *MetricsServer) StartServer() {
+	m.logger.Info("Starting MetricsServer", zap.Int("port", m.port))
+	err := http.ListenAndServe(fmt.Sprintf(":%d", m.port), m.Handler())
+	if err != nil {
+		m.logger.Panic("Failed to start metrics server", zap.Int("port", m.port), zap.Error(err))
+	}
+}
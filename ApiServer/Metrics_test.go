@@ -0,0 +1,37 @@
+package ApiServer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsServer(t *testing.T) {
+	server := httptest.NewServer(NewMetricsServer(0).Handler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("got %s with %d bytes, want the metrics", res.Status, len(body))
+	}
+
+	// nothing but the metrics
+	res, err = http.Get(server.URL + "/api/pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("got %s for the api, want it not found", res.Status)
+	}
+}
@@ -0,0 +1,436 @@
+package ApiServer
+
+import (
+	"net/http"
+	"time"
+
+	"EightSleepServer/SparkServer"
+
+	"github.com/gin-gonic/gin"
+)
+
+type podSummary struct {
+	DeviceId string `json:"device_id"`
+}
+
+func (a *ApiServer) listPods(ctx *gin.Context) {
+	pods := []podSummary{}
+	for _, pod := range a.spark.Pods() {
+		pods = append(pods, podSummary{DeviceId: pod.DeviceId()})
+	}
+	ctx.JSON(http.StatusOK, pods)
+}
+
+func (a *ApiServer) getStatus(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	status, err := pod.GetStatus()
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, status)
+}
+
+type levelRequest struct {
+	Level       *int     `json:"level"`
+	Temperature *float64 `json:"temperature"`
+	Unit        string   `json:"unit"`
+}
+
+func (a *ApiServer) putLevel(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	var req levelRequest
+	if !bind(ctx, &req) {
+		return
+	}
+
+	level := 0
+	switch {
+	case req.Level != nil:
+		level = *req.Level
+	case req.Temperature != nil:
+		unit, err := SparkServer.ParseTemperatureUnit(req.Unit)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+		level, err = pod.Calibration().Get().Level(*req.Temperature, unit, bedSide)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+	default:
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse{Error: "level or temperature is required"})
+		return
+	}
+
+	err := pod.SetLevelFrom(SparkServer.SourceApi, level, bedSide)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"level": level})
+}
+
+type timeRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+func (a *ApiServer) putTime(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	var req timeRequest
+	if !bind(ctx, &req) {
+		return
+	}
+	err := pod.SetTimeFrom(SparkServer.SourceApi, req.Seconds, bedSide)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, req)
+}
+
+func (a *ApiServer) getAlarm(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	alarm, err := pod.GetAlarm(bedSide)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, alarm)
+}
+
+func (a *ApiServer) putAlarm(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	var alarm SparkServer.AlarmParams
+	if !bind(ctx, &alarm) {
+		return
+	}
+	err := pod.Allow(SparkServer.SourceApi)
+	if err == nil {
+		err = pod.SetAlarmParams(bedSide, alarm)
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, alarm)
+}
+
+func (a *ApiServer) deleteAlarm(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	err := pod.Allow(SparkServer.SourceApi)
+	if err == nil {
+		err = pod.ClearAlarm(bedSide)
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+type rampRequest struct {
+	Goal            int `json:"goal"`
+	DurationSeconds int `json:"duration_seconds"`
+	StepSize        int `json:"step_size"`
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+func (a *ApiServer) postRamp(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	var req rampRequest
+	if !bind(ctx, &req) {
+		return
+	}
+	err := pod.Allow(SparkServer.SourceApi)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	status, err := pod.StartRamp(SparkServer.RampParams{
+		Side:     bedSide,
+		Goal:     req.Goal,
+		Duration: time.Duration(req.DurationSeconds) * time.Second,
+		StepSize: req.StepSize,
+		Interval: time.Duration(req.IntervalSeconds) * time.Second,
+	})
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, status)
+}
+
+func (a *ApiServer) deleteRamp(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	err := pod.Allow(SparkServer.SourceApi)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	pod.CancelRamp(bedSide)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (a *ApiServer) postPrime(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	err := pod.Prime(SparkServer.SourceApi)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+func (a *ApiServer) getPrimeHistory(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	primer, err := a.spark.PrimeScheduler(pod.DeviceId())
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"active": primer.Active(), "history": primer.History()})
+}
+
+func (a *ApiServer) getSettings(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	settings, err := pod.GetSettings()
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, settings)
+}
+
+type settingsRequest struct {
+	GainLeft      *int `json:"gain_left"`
+	GainRight     *int `json:"gain_right"`
+	LedBrightness *int `json:"led_brightness"`
+}
+
+func (a *ApiServer) patchSettings(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	var req settingsRequest
+	if !bind(ctx, &req) {
+		return
+	}
+	err := pod.Allow(SparkServer.SourceApi)
+	if err == nil {
+		err = pod.UpdateSettings(func(settings *SparkServer.PodSettings) {
+			if req.GainLeft != nil {
+				settings.GainLeft = *req.GainLeft
+			}
+			if req.GainRight != nil {
+				settings.GainRight = *req.GainRight
+			}
+			if req.LedBrightness != nil {
+				settings.LedBrightness = *req.LedBrightness
+			}
+		})
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	a.getSettings(ctx)
+}
+
+type brightnessRequest struct {
+	Brightness int `json:"brightness"`
+}
+
+func (a *ApiServer) getBrightness(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	brightness, err := pod.GetBrightness()
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, brightnessRequest{Brightness: brightness})
+}
+
+func (a *ApiServer) putBrightness(ctx *gin.Context) {
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	var req brightnessRequest
+	if !bind(ctx, &req) {
+		return
+	}
+	err := pod.Allow(SparkServer.SourceApi)
+	if err == nil {
+		err = pod.SetBrightness(req.Brightness)
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, req)
+}
+
+type calibrationRequest struct {
+	// either an offset directly, or a measurement taken at a known level
+	OffsetF  *float64 `json:"offset_f"`
+	Level    *int     `json:"level"`
+	Measured *float64 `json:"measured"`
+	Unit     string   `json:"unit"`
+}
+
+func (a *ApiServer) getCalibration(ctx *gin.Context) {
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	store, err := a.spark.Calibration(pod.DeviceId())
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"offset_f": store.Get().Offset(bedSide)})
+}
+
+func (a *ApiServer) putCalibration(ctx *gin.Context) {
+	bedSide, ok := side(ctx)
+	if !ok {
+		return
+	}
+	var req calibrationRequest
+	if !bind(ctx, &req) {
+		return
+	}
+	pod, ok := a.pod(ctx)
+	if !ok {
+		return
+	}
+	store, err := a.spark.Calibration(pod.DeviceId())
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	switch {
+	case req.OffsetF != nil:
+		err = store.SetOffset(bedSide, *req.OffsetF)
+	case req.Level != nil && req.Measured != nil:
+		var unit SparkServer.TemperatureUnit
+		unit, err = SparkServer.ParseTemperatureUnit(req.Unit)
+		if err == nil {
+			_, err = store.Calibrate(bedSide, *req.Level, *req.Measured, unit)
+		}
+	default:
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse{Error: "offset_f, or level and measured, are required"})
+		return
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"offset_f": store.Get().Offset(bedSide)})
+}
+
+func (a *ApiServer) getSafety(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, a.spark.Safety().Config())
+}
+
+func (a *ApiServer) putSafety(ctx *gin.Context) {
+	config := SparkServer.DefaultSafetyConfig()
+	if !bind(ctx, &config) {
+		return
+	}
+	err := a.spark.Safety().SetConfig(config)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, config)
+}
+
+type childLockRequest struct {
+	Locked bool `json:"locked"`
+}
+
+func (a *ApiServer) putChildLock(ctx *gin.Context) {
+	var req childLockRequest
+	if !bind(ctx, &req) {
+		return
+	}
+	err := a.spark.Safety().SetChildLock(req.Locked)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,172 @@
+package ApiServer
+
+import (
+	"net/http"
+
+	"EightSleepServer/SparkServer"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Schedules belong to a device id rather than a connection, so they can be managed while the pod is offline.  Changing
+them is still subject to the child lock.
+*/
+
+// allowed checks the child lock before a schedule is changed.
+func (a *ApiServer) allowed(ctx *gin.Context) bool {
+	err := a.spark.Safety().Allow(SparkServer.SourceApi)
+	if err != nil {
+		respondError(ctx, err)
+		return false
+	}
+	return true
+}
+
+func (a *ApiServer) alarmScheduler(ctx *gin.Context) (*SparkServer.AlarmScheduler, bool) {
+	scheduler, err := a.spark.AlarmScheduler(ctx.Param("pod"))
+	if err != nil {
+		respondError(ctx, err)
+		return nil, false
+	}
+	return scheduler, true
+}
+
+func (a *ApiServer) listRecurringAlarms(ctx *gin.Context) {
+	scheduler, ok := a.alarmScheduler(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, scheduler.List())
+}
+
+func (a *ApiServer) addRecurringAlarm(ctx *gin.Context) {
+	if !a.allowed(ctx) {
+		return
+	}
+	scheduler, ok := a.alarmScheduler(ctx)
+	if !ok {
+		return
+	}
+	var alarm SparkServer.RecurringAlarm
+	if !bind(ctx, &alarm) {
+		return
+	}
+	alarm, err := scheduler.Add(alarm)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, alarm)
+}
+
+func (a *ApiServer) updateRecurringAlarm(ctx *gin.Context) {
+	if !a.allowed(ctx) {
+		return
+	}
+	scheduler, ok := a.alarmScheduler(ctx)
+	if !ok {
+		return
+	}
+	var alarm SparkServer.RecurringAlarm
+	if !bind(ctx, &alarm) {
+		return
+	}
+	alarm.Id = ctx.Param("id")
+	err := scheduler.Update(alarm)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, alarm)
+}
+
+func (a *ApiServer) removeRecurringAlarm(ctx *gin.Context) {
+	if !a.allowed(ctx) {
+		return
+	}
+	scheduler, ok := a.alarmScheduler(ctx)
+	if !ok {
+		return
+	}
+	err := scheduler.Remove(ctx.Param("id"))
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (a *ApiServer) temperatureScheduler(ctx *gin.Context) (*SparkServer.TemperatureScheduler, bool) {
+	scheduler, err := a.spark.TemperatureScheduler(ctx.Param("pod"))
+	if err != nil {
+		respondError(ctx, err)
+		return nil, false
+	}
+	return scheduler, true
+}
+
+func (a *ApiServer) listPrograms(ctx *gin.Context) {
+	scheduler, ok := a.temperatureScheduler(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, scheduler.List())
+}
+
+func (a *ApiServer) addProgram(ctx *gin.Context) {
+	if !a.allowed(ctx) {
+		return
+	}
+	scheduler, ok := a.temperatureScheduler(ctx)
+	if !ok {
+		return
+	}
+	var program SparkServer.TemperatureProgram
+	if !bind(ctx, &program) {
+		return
+	}
+	program, err := scheduler.Add(program)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, program)
+}
+
+func (a *ApiServer) updateProgram(ctx *gin.Context) {
+	if !a.allowed(ctx) {
+		return
+	}
+	scheduler, ok := a.temperatureScheduler(ctx)
+	if !ok {
+		return
+	}
+	var program SparkServer.TemperatureProgram
+	if !bind(ctx, &program) {
+		return
+	}
+	program.Id = ctx.Param("id")
+	err := scheduler.Update(program)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, program)
+}
+
+func (a *ApiServer) removeProgram(ctx *gin.Context) {
+	if !a.allowed(ctx) {
+		return
+	}
+	scheduler, ok := a.temperatureScheduler(ctx)
+	if !ok {
+		return
+	}
+	err := scheduler.Remove(ctx.Param("id"))
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package ApiServer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"EightSleepServer/LogServer"
+	"EightSleepServer/SparkServer"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+/*
+An http json api for scripts and dashboards, alongside the FrankenSocket that free-sleep uses.
+Pods are addressed by the device id from their handshake, sides by "left" or "right".
+Every error comes back as {"error": "..."} with a status code derived from what went wrong.
+*/
+
+type ApiServer struct {
+	spark  *SparkServer.Server
+	logs   *LogServer.LogServer
+	tail   *LogServer.LogTail
+	token  string
+	port   int
+	engine *gin.Engine
+	logger *zap.Logger
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+var errPodNotConnected = errors.New("pod not connected")
+
+func NewApiServer(spark *SparkServer.Server, port int) *ApiServer {
+	logger, _ := zap.NewProduction()
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+
+	a := &ApiServer{
+		spark:  spark,
+		port:   port,
+		engine: engine,
+		logger: logger,
+	}
+	a.registerRoutes()
+	return a
+}
+
+// Engine exposes the router so other parts of the server can add their own endpoints.
+func (a *ApiServer) Engine() *gin.Engine {
+	return a.engine
+}
+
+func (a *ApiServer) registerRoutes() {
+	a.engine.Use(a.authorize)
+	a.engine.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	api := a.engine.Group("/api")
+	api.GET("/pods", a.listPods)
+	api.GET("/events", a.getEvents)
+	api.GET("/safety", a.getSafety)
+	api.PUT("/safety", a.putSafety)
+	api.PUT("/safety/child-lock", a.putChildLock)
+	api.GET("/logs/batches", a.listBatches)
+	api.GET("/logs/gaps", a.listBatchGaps)
+	api.GET("/logs/tail", a.getLogTail)
+
+	pod := api.Group("/pods/:pod")
+	pod.GET("/status", a.getStatus)
+	pod.GET("/events", a.getPodEvents)
+	pod.POST("/prime", a.postPrime)
+	pod.GET("/prime", a.getPrimeHistory)
+	pod.GET("/settings", a.getSettings)
+	pod.PATCH("/settings", a.patchSettings)
+	pod.GET("/brightness", a.getBrightness)
+	pod.PUT("/brightness", a.putBrightness)
+
+	pod.GET("/alarms", a.listRecurringAlarms)
+	pod.POST("/alarms", a.addRecurringAlarm)
+	pod.PUT("/alarms/:id", a.updateRecurringAlarm)
+	pod.DELETE("/alarms/:id", a.removeRecurringAlarm)
+
+	pod.GET("/programs", a.listPrograms)
+	pod.POST("/programs", a.addProgram)
+	pod.PUT("/programs/:id", a.updateProgram)
+	pod.DELETE("/programs/:id", a.removeProgram)
+
+	side := pod.Group("/sides/:side")
+	side.PUT("/level", a.putLevel)
+	side.PUT("/time", a.putTime)
+	side.GET("/alarm", a.getAlarm)
+	side.PUT("/alarm", a.putAlarm)
+	side.DELETE("/alarm", a.deleteAlarm)
+	side.POST("/ramp", a.postRamp)
+	side.DELETE("/ramp", a.deleteRamp)
+	side.GET("/calibration", a.getCalibration)
+	side.PUT("/calibration", a.putCalibration)
+}
+
+func (a *ApiServer) StartServer() {
+	a.logger.Info("Starting ApiServer", zap.Int("port", a.port))
+	err := a.engine.Run(fmt.Sprintf(":%d", a.port))
+	if err != nil {
+		a.logger.Panic("Failed to start api server", zap.Int("port", a.port), zap.Error(err))
+	}
+}
+
+// statusFor maps an error onto the http status it should be reported with.
+func statusFor(err error) int {
+	var refused *SparkServer.CommandRefusedError
+	var invalid *SparkServer.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.As(err, &refused),
+		errors.Is(err, errLocalWritesOnly):
+		return http.StatusForbidden
+	case errors.Is(err, errPodNotConnected),
+		errors.Is(err, errLogServerDisabled),
+		errors.Is(err, SparkServer.ErrAlarmNotFound),
+		errors.Is(err, SparkServer.ErrProgramNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, SparkServer.ErrPodRequestTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, SparkServer.ErrPodDisconnected):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, SparkServer.ErrPrimeInProgress):
+		return http.StatusConflict
+	default:
+		// the pod, or saving something, failed in a way we didn't expect
+		return http.StatusInternalServerError
+	}
+}
+
+func respondError(ctx *gin.Context, err error) {
+	ctx.AbortWithStatusJSON(statusFor(err), errorResponse{Error: err.Error()})
+}
+
+// pod looks up the connected pod named in the url.
+func (a *ApiServer) pod(ctx *gin.Context) (*SparkServer.PodConnection, bool) {
+	pod, ok := a.spark.GetPod(ctx.Param("pod"))
+	if !ok {
+		respondError(ctx, fmt.Errorf("%w: %s", errPodNotConnected, ctx.Param("pod")))
+		return nil, false
+	}
+	return pod, true
+}
+
+func side(ctx *gin.Context) (SparkServer.BedSide, bool) {
+	bedSide, err := SparkServer.ParseBedSide(ctx.Param("side"))
+	if err != nil {
+		respondError(ctx, err)
+		return bedSide, false
+	}
+	return bedSide, true
+}
+
+func bind(ctx *gin.Context, v interface{}) bool {
+	err := ctx.ShouldBindJSON(v)
+	if err != nil {
+		respondError(ctx, SparkServer.Invalidf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
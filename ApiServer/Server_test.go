@@ -0,0 +1,32 @@
+package ApiServer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"testing"
+
+	"EightSleepServer/SparkServer"
+)
+
+func TestStatusFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{SparkServer.Invalidf("goal %d out of range", 20), http.StatusBadRequest},
+		{fmt.Errorf("left: %w", SparkServer.Invalidf("invalid max heat time")), http.StatusBadRequest},
+		{&SparkServer.CommandRefusedError{Reason: "child lock is on"}, http.StatusForbidden},
+		{errPodNotConnected, http.StatusNotFound},
+		{SparkServer.ErrPodRequestTimeout, http.StatusGatewayTimeout},
+		{SparkServer.ErrPodDisconnected, http.StatusServiceUnavailable},
+		{fmt.Errorf("parsing current heat level: %w", errors.New("bad reply")), http.StatusInternalServerError},
+		{&fs.PathError{Op: "open", Path: "calibration.json", Err: fs.ErrPermission}, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := statusFor(test.err); got != test.want {
+			t.Errorf("statusFor(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
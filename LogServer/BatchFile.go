@@ -0,0 +1,132 @@
+package LogServer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+A batch is written to <name>.RAW.<random>.tmp and only renamed to <name>.RAW once it is complete and on disk, so
+anything with the final name is a whole batch.  The random part keeps a session that is being closed from touching
+the file of the one that replaced it, when the pod resends the same batch on a new connection.  Batches the pod
+abandons part way are moved to the quarantine folder instead.
+*/
+
+const (
+	tempSuffix       = ".tmp"
+	quarantineFolder = "partial"
+)
+
+type batchFile struct {
+	path   string // final name
+	temp   string // name while it's being written
+	osFile *os.File
+	writer *bufio.Writer
+}
+
+func createBatchFile(path string) (*batchFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	osFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp leaves it readable only by us, free-sleep may run as someone else
+	err = osFile.Chmod(0644)
+	if err != nil {
+		_ = osFile.Close()
+		_ = os.Remove(osFile.Name())
+		return nil, err
+	}
+	return &batchFile{path: path, temp: osFile.Name(), osFile: osFile, writer: bufio.NewWriterSize(osFile, 64*1024)}, nil
+}
+
+func (f *batchFile) Write(data []byte) error {
+	_, err := f.writer.Write(data)
+	return err
+}
+
+// Commit makes the batch durable under its final name.  The pod shouldn't be acked until this succeeds.
+func (f *batchFile) Commit() error {
+	err := f.writer.Flush()
+	if err == nil {
+		err = f.osFile.Sync()
+	}
+	closeErr := f.osFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.temp, f.path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Quarantine moves an incomplete batch out of the way, returning where it went.
+func (f *batchFile) Quarantine() (string, error) {
+	_ = f.writer.Flush()
+	_ = f.osFile.Close()
+	return quarantine(f.temp)
+}
+
+// quarantine moves a partial batch file into the quarantine folder next to it, as <name>.<time>.<random>.RAW, so a
+// resent batch that fails again doesn't overwrite it, even within the same second.  The random part is the temporary
+// file's.
+func quarantine(tempPath string) (string, error) {
+	dir := filepath.Join(filepath.Dir(tempPath), quarantineFolder)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	name, random, _ := strings.Cut(strings.TrimSuffix(filepath.Base(tempPath), tempSuffix), ".RAW.")
+	stamp := time.Now().UTC().Format("20060102T150405")
+	destination := filepath.Join(dir, fmt.Sprintf("%s.%s.%s.RAW", name, stamp, random))
+	return destination, os.Rename(tempPath, destination)
+}
+
+// quarantineLeftovers moves the temporary files left behind by a crash into quarantine.
+func quarantineLeftovers(root string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(root, "*", "*.RAW.*"+tempSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var moved []string
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".gz"+tempSuffix) {
+			// half compressed, see removeCompressionLeftovers
+			continue
+		}
+		destination, err := quarantine(match)
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, destination)
+	}
+	return moved, nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Sync()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package LogServer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResentBatchKeepsItsOwnFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pod", "00000001.RAW")
+	// the pod resends the batch on a new connection before the old one has been closed
+	old, err := createBatchFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resent, err := createBatchFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Write([]byte("cut short")); err != nil {
+		t.Fatal(err)
+	}
+	if err = resent.Write([]byte("whole")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = old.Quarantine(); err != nil {
+		t.Fatal(err)
+	}
+	if err = resent.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "whole" {
+		t.Errorf("got %q, want the resent batch", data)
+	}
+}
+
+func TestQuarantineLeftovers(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "pod")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"00000001.RAW.654321.tmp", "00000002.RAW.123456.tmp", "00000003.RAW.gz.tmp"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := quarantineLeftovers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 2 {
+		t.Fatalf("moved %v, want the two batches", moved)
+	}
+	for i, destination := range moved {
+		name := filepath.Base(destination)
+		if filepath.Dir(destination) != filepath.Join(dir, quarantineFolder) ||
+			!strings.HasPrefix(name, []string{"00000001.", "00000002."}[i]) ||
+			!strings.HasSuffix(name, []string{".654321.RAW", ".123456.RAW"}[i]) || strings.Count(name, ".RAW") != 1 {
+			t.Errorf("moved to %s", destination)
+		}
+	}
+	// compression leftovers are removeCompressionLeftovers' to clean up
+	if !fileExists(filepath.Join(dir, "00000003.RAW.gz.tmp")) {
+		t.Error("half compressed file was quarantined")
+	}
+}
+
+func TestQuarantinedNamesDontCollide(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pod", "00000001.RAW")
+	// the same batch abandoned twice within a second
+	var destinations []string
+	for i := 0; i < 2; i++ {
+		file, err := createBatchFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		destination, err := file.Quarantine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		destinations = append(destinations, destination)
+	}
+	if destinations[0] == destinations[1] {
+		t.Fatalf("both quarantined to %s", destinations[0])
+	}
+	for _, destination := range destinations {
+		if !fileExists(destination) {
+			t.Errorf("%s is missing", destination)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package LogServer
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+The batch index is a json lines file with an entry for every batch received, saved or not.  Batch ids count up, so
+comparing each id with the last one from the same pod shows batches that never arrived or came out of order, which
+tells us whether the pod's sd card backlog was fully drained.
+
+Only the newest maxEntries are kept in memory, so the api and gaps cover that window.  Once the file passes
+maxFileSize it is moved to <path>.1, replacing the one before, and a new one started.
+*/
+
+const (
+	defaultIndexEntries  = 10000
+	defaultIndexFileSize = 10 * 1024 * 1024
+)
+
+type BatchStatus string
+
+const (
+	BatchSaved     BatchStatus = "saved"
+	BatchReceived  BatchStatus = "received" // acked without saving, files are off or disk space is low
+	BatchDuplicate BatchStatus = "duplicate"
+	BatchPartial   BatchStatus = "partial"
+	BatchFailed    BatchStatus = "failed" // complete, but couldn't be saved, so not acked
+)
+
+type BatchEntry struct {
+	DeviceId   string      `json:"device_id"`
+	BatchId    *uint32     `json:"batch_id,omitempty"` // nil for batches the pod didn't announce
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	Bytes      uint64      `json:"bytes"`
+	Acked      bool        `json:"acked"`
+	Status     BatchStatus `json:"status"`
+	Missing    uint32      `json:"missing,omitempty"` // ids skipped between the previous batch and this one
+	OutOfOrder bool        `json:"out_of_order,omitempty"`
+}
+
+// BatchGap is a run of batch ids that were never received.
+type BatchGap struct {
+	DeviceId string `json:"device_id"`
+	From     uint32 `json:"from"`
+	To       uint32 `json:"to"`
+}
+
+type BatchIndex struct {
+	path        string
+	maxEntries  int
+	maxFileSize int64
+	fileSize    int64
+	entries     []BatchEntry      // the newest maxEntries, oldest first
+	lastId      map[string]uint32 // highest batch id seen per device
+	mutex       sync.Mutex
+	logger      *zap.Logger
+}
+
+// NewBatchIndex opens the index at path, reading back what's already there.  maxEntries and maxFileSize of 0 or
+// less use the defaults.
+func NewBatchIndex(path string, maxEntries int, maxFileSize int64, logger *zap.Logger) (*BatchIndex, error) {
+	if maxEntries <= 0 {
+		maxEntries = defaultIndexEntries
+	}
+	if maxFileSize <= 0 {
+		maxFileSize = defaultIndexFileSize
+	}
+	index := &BatchIndex{path: path, maxEntries: maxEntries, maxFileSize: maxFileSize, lastId: make(map[string]uint32), logger: logger}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// check it can be written now rather than on the first batch
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	index.fileSize = info.Size()
+
+	for _, name := range []string{path + ".1", path} {
+		err := index.load(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+func (i *BatchIndex) load(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry BatchEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// most likely the last line, cut short by a crash
+			i.logger.Warn("Skipping unreadable batch index entry", zap.Error(err))
+			continue
+		}
+		i.remember(entry)
+		i.track(entry)
+	}
+	return scanner.Err()
+}
+
+// remember adds an entry to the ones kept in memory, dropping the oldest past maxEntries.
+func (i *BatchIndex) remember(entry BatchEntry) {
+	if len(i.entries) >= i.maxEntries {
+		// shift down rather than reslice, so the array doesn't creep forward and keep growing
+		n := copy(i.entries, i.entries[len(i.entries)-i.maxEntries+1:])
+		i.entries = i.entries[:n]
+	}
+	i.entries = append(i.entries, entry)
+}
+
+func (i *BatchIndex) track(entry BatchEntry) {
+	if entry.BatchId == nil || !entry.Acked {
+		return
+	}
+	last, ok := i.lastId[entry.DeviceId]
+	if !ok || *entry.BatchId > last {
+		i.lastId[entry.DeviceId] = *entry.BatchId
+	}
+}
+
+// Add flags the entry against the batches before it and appends it to the index.
+func (i *BatchIndex) Add(entry BatchEntry) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if entry.BatchId != nil && entry.Status != BatchDuplicate {
+		last, ok := i.lastId[entry.DeviceId]
+		id := *entry.BatchId
+		switch {
+		case !ok:
+		case id > last+1:
+			entry.Missing = id - last - 1
+			i.logger.Warn("Batches missing", zap.String("device_id", entry.DeviceId), zap.Uint32("from", last+1), zap.Uint32("to", id-1))
+		case id <= last:
+			entry.OutOfOrder = true
+			i.logger.Warn("Batch out of order", zap.String("device_id", entry.DeviceId), zap.Uint32("batch_id", id), zap.Uint32("last", last))
+		}
+	}
+	i.track(entry)
+	i.remember(entry)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		i.logger.Error("Error encoding batch index entry", zap.Error(err))
+		return
+	}
+	file, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		i.logger.Error("Error opening batch index", zap.Error(err))
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	n, err := file.Write(append(line, '\n'))
+	i.fileSize += int64(n)
+	if err != nil {
+		i.logger.Error("Error writing batch index", zap.Error(err))
+		return
+	}
+	if i.fileSize >= i.maxFileSize {
+		i.rotate()
+	}
+}
+
+// rotate moves the index file to <path>.1 so the next entry starts a new one.
+func (i *BatchIndex) rotate() {
+	err := os.Rename(i.path, i.path+".1")
+	if err != nil {
+		i.logger.Error("Error rotating batch index", zap.Error(err))
+		return
+	}
+	i.fileSize = 0
+}
+
+// Entries returns the entries kept in memory, optionally for one device, oldest first.
+func (i *BatchIndex) Entries(deviceId string) []BatchEntry {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entries := make([]BatchEntry, 0, len(i.entries))
+	for _, entry := range i.entries {
+		if deviceId == "" || entry.DeviceId == deviceId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Gaps returns the batch ids never acked between the lowest and highest acked for each device within the entries
+// kept in memory, optionally for one device.
+func (i *BatchIndex) Gaps(deviceId string) []BatchGap {
+	received := make(map[string][]uint32)
+	for _, entry := range i.Entries(deviceId) {
+		if entry.BatchId != nil && entry.Acked {
+			received[entry.DeviceId] = append(received[entry.DeviceId], *entry.BatchId)
+		}
+	}
+
+	devices := make([]string, 0, len(received))
+	for device := range received {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	gaps := make([]BatchGap, 0)
+	for _, device := range devices {
+		ids := received[device]
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		for n := 1; n < len(ids); n++ {
+			if ids[n] > ids[n-1]+1 {
+				gaps = append(gaps, BatchGap{DeviceId: device, From: ids[n-1] + 1, To: ids[n] - 1})
+			}
+		}
+	}
+	return gaps
+}
@@ -0,0 +1,96 @@
+package LogServer
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func ackedEntry(deviceId string, batchId uint32) BatchEntry {
+	return BatchEntry{DeviceId: deviceId, BatchId: &batchId, Acked: true, Status: BatchSaved}
+}
+
+func TestBatchIndexKeepsAWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batches.jsonl")
+	index, err := NewBatchIndex(path, 3, 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{1, 2, 3, 5, 6} {
+		index.Add(ackedEntry("pod", id))
+	}
+	entries := index.Entries("")
+	if len(entries) != 3 || *entries[0].BatchId != 3 || *entries[2].BatchId != 6 {
+		t.Fatalf("got %+v, want batches 3, 5 and 6", entries)
+	}
+	if entries[1].Missing != 1 {
+		t.Errorf("batch 5 missing %d, want 1", entries[1].Missing)
+	}
+	gaps := index.Gaps("pod")
+	if len(gaps) != 1 || gaps[0].From != 4 || gaps[0].To != 4 {
+		t.Errorf("got gaps %+v, want 4", gaps)
+	}
+}
+
+func TestBatchIndexRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batches.jsonl")
+	entry := ackedEntry("pod", 1)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for two entries a file
+	index, err := NewBatchIndex(path, 0, int64(2*len(line)+1), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(1); id <= 3; id++ {
+		index.Add(ackedEntry("pod", id))
+	}
+	for name, want := range map[string]int{path + ".1": 2, path: 1} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := bytes.Count(data, []byte("\n")); lines != want {
+			t.Errorf("%s has %d entries, want %d", filepath.Base(name), lines, want)
+		}
+	}
+
+	// both files are read back, and it carries on from their ids
+	index, err = NewBatchIndex(path, 0, int64(2*len(line)+1), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := index.Entries("pod"); len(entries) != 3 {
+		t.Fatalf("reopened with %+v, want batches 1 to 3", entries)
+	}
+	index.Add(ackedEntry("pod", 5))
+	entries := index.Entries("pod")
+	if entries[len(entries)-1].Missing != 1 {
+		t.Errorf("batch 5 after a reopen missing %d, want 1", entries[len(entries)-1].Missing)
+	}
+}
+
+func TestBatchIndexUnwritable(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	err := os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewBatchIndex(filepath.Join(file, "batches.jsonl"), 0, 0, zap.NewNop())
+	if err == nil {
+		t.Error("expected an error")
+	}
+
+	var server LogServer
+	err = server.SetIndexPath(filepath.Join(file, "batches.jsonl"))
+	if err == nil || server.Index() != nil {
+		t.Errorf("got %v and index %v, want an error and no index", err, server.Index())
+	}
+}
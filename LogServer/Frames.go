@@ -0,0 +1,305 @@
+package LogServer
+
+import (
+	"encoding/binary"
+)
+
+/*
+Everything the pod sends is one cbor stream.  A batch start is really the beginning of a map whose last value,
+"stream", is an indefinite length byte string:
+
+	{"proto": "raw", "part": "batch", "id": <batch id>, "stream": (_ h'..', h'..', ...)}
+
+so each data payload is one chunk of that byte string, and the 0xFF that ends a batch is the byte string's break.
+The decoder works on whatever has arrived so far, and doesn't care what order the frames come in: the pod can skip
+the welcome or the batch start and its data is still picked up.
+*/
+
+type FrameType int
+
+const (
+	FrameWelcome FrameType = iota
+	FrameBatchStart
+	FrameData
+	FrameBatchEnd
+)
+
+type Frame struct {
+	Type    FrameType
+	Welcome WelcomeMessage // FrameWelcome
+	BatchId uint32         // FrameBatchStart
+	Data    []byte         // FrameData
+}
+
+type decodeStatus int
+
+const (
+	decodeOk decodeStatus = iota
+	decodeNeedMore
+	decodeInvalid
+	decodeUnknown // well formed cbor, but not a frame the pod sends, to be skipped whole
+)
+
+// maxMapItemLength bounds the strings in a welcome or batch start, so garbage that happens to look like a map isn't
+// waited on forever.
+const maxMapItemLength = 1024
+
+// maxMapItems bounds the entries in a map, or anything nested in it, for the same reason.
+const maxMapItems = 32
+
+// maxNesting bounds how deep arrays, maps and tags in a welcome or batch start can go.
+const maxNesting = 8
+
+// maxHeadLength is the longest cbor item head: an initial byte and an 8 byte argument.
+const maxHeadLength = 9
+
+// readHead parses the head of a cbor item, returning the major type, the additional info, its argument and the
+// length of the head.
+func readHead(data []byte) (byte, byte, uint64, int, decodeStatus) {
+	if len(data) < 1 {
+		return 0, 0, 0, 0, decodeNeedMore
+	}
+	major := data[0] >> 5
+	ai := data[0] & 0x1f
+	switch {
+	case ai < 24:
+		return major, ai, uint64(ai), 1, decodeOk
+	case ai == 31:
+		// indefinite length, or break
+		return major, ai, 0, 1, decodeOk
+	case ai > 27:
+		return major, ai, 0, 0, decodeInvalid
+	}
+	size := 1 << (ai - 24)
+	if len(data) < 1+size {
+		return 0, 0, 0, 0, decodeNeedMore
+	}
+	var value uint64
+	switch size {
+	case 1:
+		value = uint64(data[1])
+	case 2:
+		value = uint64(binary.BigEndian.Uint16(data[1:]))
+	case 4:
+		value = uint64(binary.BigEndian.Uint32(data[1:]))
+	case 8:
+		value = binary.BigEndian.Uint64(data[1:])
+	}
+	return major, ai, value, 1 + size, decodeOk
+}
+
+// decodeMapFrame decodes a welcome or batch start map at the start of data, returning its frames and the number of
+// bytes they took up.  A batch start normally stops just after the indefinite byte string that opens the stream.  If
+// the stream is instead a definite byte string, of up to maxData bytes, the whole batch is in the map, and it comes
+// back as a batch start, its data and a batch end.  A map that isn't a welcome or batch start is decodeUnknown.
+func decodeMapFrame(data []byte, maxData int) ([]Frame, int, decodeStatus) {
+	major, ai, count, pos, status := readHead(data)
+	if status != decodeOk {
+		return nil, 0, status
+	}
+	if major != 5 || count > maxMapItems {
+		return nil, 0, decodeInvalid
+	}
+	indefinite := ai == 31
+
+	fields := make(map[string]interface{})
+	streamOpened := false
+	var streamData []byte // the data of a stream sent as a definite byte string
+	for i := uint64(0); indefinite || i < count; i++ {
+		if indefinite {
+			if pos >= len(data) {
+				return nil, 0, decodeNeedMore
+			}
+			if data[pos] == 0xff {
+				pos++
+				break
+			}
+			if i >= maxMapItems {
+				return nil, 0, decodeInvalid
+			}
+		}
+		key, n, status := readItem(data[pos:])
+		if status != decodeOk {
+			return nil, 0, status
+		}
+		pos += n
+		keyString, _ := key.(string)
+
+		if keyString == "stream" {
+			if pos >= len(data) {
+				return nil, 0, decodeNeedMore
+			}
+			if data[pos] == 0x5f {
+				// the rest of the map is the batch's data, which is decoded as frames of its own
+				pos++
+				streamOpened = true
+				break
+			}
+			major, ai, length, headLength, status := readHead(data[pos:])
+			if status != decodeOk {
+				return nil, 0, status
+			}
+			if major != 2 || ai == 31 || length > uint64(maxData) {
+				// not a stream that can be followed
+				return nil, 0, decodeInvalid
+			}
+			end := pos + headLength + int(length)
+			if end > len(data) {
+				return nil, 0, decodeNeedMore
+			}
+			streamData = data[pos+headLength : end]
+			pos = end
+			continue
+		}
+		// anything else, including entries with keys other than strings, is read over whatever it holds
+		value, n, status := readItem(data[pos:])
+		if status != decodeOk {
+			return nil, 0, status
+		}
+		pos += n
+		if keyString != "" {
+			fields[keyString] = value
+		}
+	}
+
+	part, _ := fields["part"].(string)
+	switch part {
+	case "session":
+		welcome := WelcomeMessage{Part: part}
+		welcome.Proto, _ = fields["proto"].(string)
+		welcome.Version, _ = fields["version"].(string)
+		welcome.DeviceId, _ = fields["dev"].(string)
+		return []Frame{{Type: FrameWelcome, Welcome: welcome}}, pos, decodeOk
+	case "batch":
+		id, _ := fields["id"].(uint64)
+		frames := []Frame{{Type: FrameBatchStart, BatchId: uint32(id)}}
+		if streamData != nil {
+			if len(streamData) > 0 {
+				frames = append(frames, Frame{Type: FrameData, Data: streamData})
+			}
+			frames = append(frames, Frame{Type: FrameBatchEnd})
+		}
+		return frames, pos, decodeOk
+	}
+	if streamOpened {
+		// can't skip a map whose end is somewhere after the stream, its data is picked up as an unannounced batch
+		return nil, 0, decodeInvalid
+	}
+	return nil, pos, decodeUnknown
+}
+
+// readItem reads a single cbor item of any type.  Unsigned integers come back as uint64 and text and byte strings,
+// definite or not, as string and []byte, which is all the pod's maps have been seen to hold.  Anything else is read
+// over and comes back as nil.
+func readItem(data []byte) (interface{}, int, decodeStatus) {
+	return readNestedItem(data, 0)
+}
+
+func readNestedItem(data []byte, depth int) (interface{}, int, decodeStatus) {
+	if depth > maxNesting {
+		return nil, 0, decodeInvalid
+	}
+	major, ai, value, pos, status := readHead(data)
+	if status != decodeOk {
+		return nil, 0, status
+	}
+	switch major {
+	case 0, 1:
+		if ai == 31 {
+			return nil, 0, decodeInvalid
+		}
+		if major == 1 {
+			// negative integers, the pod doesn't send any
+			return nil, pos, decodeOk
+		}
+		return value, pos, decodeOk
+
+	case 2, 3:
+		if ai != 31 {
+			if value > maxMapItemLength {
+				return nil, 0, decodeInvalid
+			}
+			end := pos + int(value)
+			if end > len(data) {
+				return nil, 0, decodeNeedMore
+			}
+			return stringItem(major, data[pos:end]), end, decodeOk
+		}
+		// indefinite length, definite chunks of the same type up to a break
+		joined := []byte{}
+		for {
+			if pos >= len(data) {
+				return nil, 0, decodeNeedMore
+			}
+			if data[pos] == 0xff {
+				return stringItem(major, joined), pos + 1, decodeOk
+			}
+			chunkMajor, chunkAi, length, headLength, status := readHead(data[pos:])
+			if status != decodeOk {
+				return nil, 0, status
+			}
+			if chunkMajor != major || chunkAi == 31 || uint64(len(joined))+length > maxMapItemLength {
+				return nil, 0, decodeInvalid
+			}
+			end := pos + headLength + int(length)
+			if end > len(data) {
+				return nil, 0, decodeNeedMore
+			}
+			joined = append(joined, data[pos+headLength:end]...)
+			pos = end
+		}
+
+	case 4, 5:
+		if value > maxMapItems {
+			return nil, 0, decodeInvalid
+		}
+		items := value
+		if major == 5 {
+			items *= 2
+		}
+		for i := uint64(0); ai == 31 || i < items; i++ {
+			if ai == 31 {
+				if pos >= len(data) {
+					return nil, 0, decodeNeedMore
+				}
+				if data[pos] == 0xff {
+					pos++
+					break
+				}
+				if i >= 2*maxMapItems {
+					return nil, 0, decodeInvalid
+				}
+			}
+			_, n, status := readNestedItem(data[pos:], depth+1)
+			if status != decodeOk {
+				return nil, 0, status
+			}
+			pos += n
+		}
+		return nil, pos, decodeOk
+
+	case 6:
+		// a tag, followed by the item it tags
+		if ai == 31 {
+			return nil, 0, decodeInvalid
+		}
+		_, n, status := readNestedItem(data[pos:], depth+1)
+		if status != decodeOk {
+			return nil, 0, status
+		}
+		return nil, pos + n, decodeOk
+	}
+
+	// simple values and floats, which are all head, but a break outside of an indefinite length item is out of place
+	if ai == 31 {
+		return nil, 0, decodeInvalid
+	}
+	return nil, pos, decodeOk
+}
+
+func stringItem(major byte, data []byte) interface{} {
+	if major == 3 {
+		return string(data)
+	}
+	return data
+}
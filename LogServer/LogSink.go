@@ -0,0 +1,78 @@
+package LogServer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Batch describes the batch a sink is being given data for.
+type Batch struct {
+	DeviceId string
+	Id       uint32
+	HasId    bool   // false when the pod skipped the batch start
+	Name     string // the id in hex, or unannounced-<time>, for naming files
+	Started  time.Time
+	Saved    bool // set by a sink that has made the batch durable
+}
+
+// LogSink is somewhere the log stream goes.  StartBatch and EndBatch bracket every batch, and Write is given each
+// byte string in between, which is only valid during the call.
+// A finished batch is only acked if every sink's EndBatch succeeds, so only sinks the pod should resend for return
+// an error there.  Sessions run concurrently, so sinks must be safe to call from several goroutines.
+type LogSink interface {
+	Name() string
+	StartBatch(batch *Batch) error
+	Write(batch *Batch, data []byte) error
+	EndBatch(batch *Batch, finished bool) error
+}
+
+// AddSink registers somewhere for the log stream to go, must be called before StartServer.
+func (b *LogServer) AddSink(sink LogSink) {
+	b.sinks.sinks = append(b.sinks.sinks, sink)
+}
+
+// fanOut hands the stream to every sink in turn.  A sink failing is logged and doesn't stop the others.
+type fanOut struct {
+	sinks  []LogSink
+	logger *zap.Logger
+}
+
+func (f fanOut) StartBatch(batch *Batch) {
+	for _, sink := range f.sinks {
+		err := sink.StartBatch(batch)
+		if err != nil {
+			f.failed(sink, "Error starting batch", batch, err)
+		}
+	}
+}
+
+func (f fanOut) Write(batch *Batch, data []byte) {
+	for _, sink := range f.sinks {
+		err := sink.Write(batch, data)
+		if err != nil {
+			f.failed(sink, "Error writing batch", batch, err)
+		}
+	}
+}
+
+// EndBatch returns the errors from every sink that couldn't keep the batch.
+func (f fanOut) EndBatch(batch *Batch, finished bool) error {
+	var errs []error
+	for _, sink := range f.sinks {
+		err := sink.EndBatch(batch, finished)
+		if err != nil {
+			f.failed(sink, "Error ending batch", batch, err)
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanOut) failed(sink LogSink, message string, batch *Batch, err error) {
+	sinkErrorsTotal.WithLabelValues(sink.Name()).Inc()
+	f.logger.Error(message, zap.String("sink", sink.Name()), zap.String("device_id", batch.DeviceId),
+		zap.String("batch_id", batch.Name), zap.Error(err))
+}
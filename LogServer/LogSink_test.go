@@ -0,0 +1,56 @@
+package LogServer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// recordingSink notes what it's given, failing every call if err is set.
+type recordingSink struct {
+	name  string
+	err   error
+	calls []string
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) StartBatch(batch *Batch) error {
+	s.calls = append(s.calls, "start "+batch.Name)
+	return s.err
+}
+
+func (s *recordingSink) Write(_ *Batch, data []byte) error {
+	s.calls = append(s.calls, "write "+string(data))
+	return s.err
+}
+
+func (s *recordingSink) EndBatch(batch *Batch, _ bool) error {
+	s.calls = append(s.calls, "end "+batch.Name)
+	return s.err
+}
+
+func TestFanOutCarriesOnPastAFailingSink(t *testing.T) {
+	failing := &recordingSink{name: "failing", err: errors.New("disk full")}
+	working := &recordingSink{name: "working"}
+	sinks := fanOut{sinks: []LogSink{failing, working}, logger: zap.NewNop()}
+
+	batch := &Batch{DeviceId: "pod", Name: "00000001"}
+	sinks.StartBatch(batch)
+	sinks.Write(batch, []byte("data"))
+	err := sinks.EndBatch(batch, true)
+
+	if err == nil || !strings.Contains(err.Error(), "failing") {
+		t.Errorf("got %v, want the failing sink's error", err)
+	}
+	want := []string{"start 00000001", "write data", "end 00000001"}
+	for _, sink := range []*recordingSink{failing, working} {
+		if strings.Join(sink.calls, ", ") != strings.Join(want, ", ") {
+			t.Errorf("%s sink got %v, want %v", sink.name, sink.calls, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package LogServer
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// minTextLength is the shortest run of printable bytes shown as a log line, shorter ones are usually binary data that
+// happens to be printable.
+const minTextLength = 4
+
+// LogLine is one line of firmware log text, read out of the stream.
+type LogLine struct {
+	DeviceId string    `json:"device_id"`
+	Time     time.Time `json:"time"` // when it was received, the pod's own timestamp hasn't been decoded
+	Message  string    `json:"message"`
+}
+
+// TailFilter picks the log lines a subscriber wants.  Zero values match everything.
+type TailFilter struct {
+	DeviceId string
+	Contains string // case insensitive
+}
+
+func (f TailFilter) Matches(line LogLine) bool {
+	if f.DeviceId != "" && line.DeviceId != f.DeviceId {
+		return false
+	}
+	return f.Contains == "" || strings.Contains(strings.ToLower(line.Message), strings.ToLower(f.Contains))
+}
+
+type tailSubscriber struct {
+	filter TailFilter
+	lines  chan LogLine
+}
+
+// LogTail fans the firmware's log text out to live subscribers, whether or not batches are being saved.  The record
+// layout hasn't been worked out (see Readme.md), so rather than decoding messages it picks out runs of printable text
+// the way strings(1) does, joining up a line split across byte strings.  A subscriber that falls behind misses lines
+// rather than holding up the stream.
+type LogTail struct {
+	subscribers map[*tailSubscriber]struct{}
+	partial     map[*Batch][]byte // text at the end of the last byte string, which may carry on in the next
+	mutex       sync.Mutex
+}
+
+func NewLogTail() *LogTail {
+	return &LogTail{
+		subscribers: make(map[*tailSubscriber]struct{}),
+		partial:     make(map[*Batch][]byte),
+	}
+}
+
+// Subscribe returns a channel of the log lines matching filter and a function to stop receiving them.
+func (t *LogTail) Subscribe(filter TailFilter) (<-chan LogLine, func()) {
+	subscriber := &tailSubscriber{filter: filter, lines: make(chan LogLine, 256)}
+	t.mutex.Lock()
+	t.subscribers[subscriber] = struct{}{}
+	t.mutex.Unlock()
+
+	var once sync.Once
+	return subscriber.lines, func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			delete(t.subscribers, subscriber)
+			t.mutex.Unlock()
+			close(subscriber.lines)
+		})
+	}
+}
+
+func (t *LogTail) Name() string {
+	return "tail"
+}
+
+func (t *LogTail) StartBatch(*Batch) error {
+	return nil
+}
+
+func (t *LogTail) Write(batch *Batch, data []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.subscribers) == 0 {
+		delete(t.partial, batch)
+		return nil
+	}
+	text := t.partial[batch]
+	for _, b := range data {
+		if b == '\t' || (b >= ' ' && b <= '~') {
+			text = append(text, b)
+			continue
+		}
+		t.publishLocked(batch.DeviceId, text)
+		text = text[:0]
+	}
+	t.partial[batch] = text
+	return nil
+}
+
+// EndBatch publishes whatever text the batch ended on.
+func (t *LogTail) EndBatch(batch *Batch, _ bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.publishLocked(batch.DeviceId, t.partial[batch])
+	delete(t.partial, batch)
+	return nil
+}
+
+func (t *LogTail) publishLocked(deviceId string, text []byte) {
+	message := strings.TrimSpace(string(text))
+	if len(message) < minTextLength {
+		return
+	}
+	line := LogLine{DeviceId: deviceId, Time: time.Now(), Message: message}
+	for subscriber := range t.subscribers {
+		if !subscriber.filter.Matches(line) {
+			continue
+		}
+		select {
+		case subscriber.lines <- line:
+		default:
+		}
+	}
+}
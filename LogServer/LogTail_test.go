@@ -0,0 +1,75 @@
+package LogServer
+
+import (
+	"testing"
+)
+
+func receiveLines(lines <-chan LogLine) []string {
+	var messages []string
+	for {
+		select {
+		case line := <-lines:
+			messages = append(messages, line.DeviceId+": "+line.Message)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestLogTailPicksOutText(t *testing.T) {
+	tail := NewLogTail()
+	lines, unsubscribe := tail.Subscribe(TailFilter{})
+	defer unsubscribe()
+
+	// not a real capture, just text between bytes that aren't
+	batch := &Batch{DeviceId: "pod"}
+	_ = tail.StartBatch(batch)
+	_ = tail.Write(batch, []byte("\x01\x02\x10\x00heater on\n\x00\x00\x00\x03ab\x00pump sp"))
+	_ = tail.Write(batch, []byte("eed 40\x00\x00\x00\x05tail at the end"))
+	_ = tail.EndBatch(batch, true)
+
+	want := []string{"pod: heater on", "pod: pump speed 40", "pod: tail at the end"}
+	got := receiveLines(lines)
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLogTailFilter(t *testing.T) {
+	tail := NewLogTail()
+	lines, unsubscribe := tail.Subscribe(TailFilter{DeviceId: "pod", Contains: "HEATER"})
+	defer unsubscribe()
+
+	other := &Batch{DeviceId: "other"}
+	_ = tail.Write(other, []byte("heater fault\x00"))
+	batch := &Batch{DeviceId: "pod"}
+	_ = tail.Write(batch, []byte("pump fault\x00heater fault\x00"))
+
+	got := receiveLines(lines)
+	if len(got) != 1 || got[0] != "pod: heater fault" {
+		t.Errorf("got %q, want only the pod's heater line", got)
+	}
+}
+
+func TestLogTailUnsubscribeWhileSending(t *testing.T) {
+	tail := NewLogTail()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		batch := &Batch{DeviceId: "pod"}
+		for i := 0; i < 1000; i++ {
+			_ = tail.Write(batch, []byte("line\x00"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, unsubscribe := tail.Subscribe(TailFilter{})
+		unsubscribe()
+		unsubscribe()
+	}
+	<-done
+}
@@ -0,0 +1,53 @@
+package LogServer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	bytesReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_bytes_received_total",
+		Help: "Record bytes received on the log stream.",
+	})
+	batchesReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_batches_received_total",
+		Help: "Log batches received and acked.",
+	})
+	bytesSkippedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_bytes_skipped_total",
+		Help: "Bytes on the log stream that weren't part of any frame.",
+	})
+	duplicateBatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_duplicate_batches_total",
+		Help: "Batches the pod resent after they had already been saved.",
+	})
+	quarantinedBatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_quarantined_batches_total",
+		Help: "Partial batches moved to quarantine.",
+	})
+	batchesNotSavedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_batches_not_saved_total",
+		Help: "Batches received without saving because disk space was low.",
+	})
+	filesDeletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_files_deleted_total",
+		Help: "Saved batches removed by the retention policy.",
+	})
+	savedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eightsleep_log_saved_bytes",
+		Help: "Bytes taken up by saved batches.",
+	})
+	diskFreeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eightsleep_log_disk_free_bytes",
+		Help: "Free space on the filesystem batches are saved to.",
+	})
+	sinkErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eightsleep_log_sink_errors_total",
+		Help: "Errors from the log sinks.",
+	}, []string{"sink"})
+	logConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eightsleep_log_connections_total",
+		Help: "Connections accepted by the log server.",
+	})
+)
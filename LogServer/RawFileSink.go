@@ -0,0 +1,140 @@
+package LogServer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var errBatchNotCreated = errors.New("batch file couldn't be created")
+
+// RawFileSink saves each batch as it came off the wire to <path>/<device id>/<batch id>.RAW, durably, before it is
+// acked.  See BatchFile.go.
+type RawFileSink struct {
+	path     string
+	minFree  uint64
+	compress bool
+	files    map[*Batch]*batchFile // nil for a batch not being saved
+	mutex    sync.Mutex
+	logger   *zap.Logger
+}
+
+// NewRawFileSink creates the log folder and quarantines anything a crash left half written.  The retention policy's
+// MinFreeBytes and Compress apply.
+func NewRawFileSink(path string, policy RetentionPolicy) (*RawFileSink, error) {
+	logger, _ := zap.NewProduction()
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := quarantineLeftovers(path)
+	if err != nil {
+		logger.Error("Error quarantining partial batches", zap.Error(err))
+	}
+	for _, file := range moved {
+		logger.Warn("Quarantined partial batch left from last run", zap.String("file", file))
+	}
+	removeCompressionLeftovers(path)
+	return &RawFileSink{
+		path:     path,
+		minFree:  policy.MinFreeBytes,
+		compress: policy.Compress,
+		files:    make(map[*Batch]*batchFile),
+		logger:   logger,
+	}, nil
+}
+
+func (s *RawFileSink) Name() string {
+	return "raw"
+}
+
+func (s *RawFileSink) fileName(deviceId string, name string) string {
+	return filepath.Join(s.path, deviceId, name+".RAW")
+}
+
+// Has reports whether a batch has already been saved.
+func (s *RawFileSink) Has(deviceId string, name string) bool {
+	fileName := s.fileName(deviceId, name)
+	return fileExists(fileName) || fileExists(fileName+".gz")
+}
+
+func (s *RawFileSink) StartBatch(batch *Batch) error {
+	fileName := s.fileName(batch.DeviceId, batch.Name)
+	enough, err := hasSpace(s.path, s.minFree)
+	if err != nil {
+		s.logger.Error("Error checking free space", zap.Error(err))
+	}
+	if !enough {
+		batchesNotSavedTotal.Inc()
+		s.logger.Warn("Low on disk space, receiving stream without saving", zap.String("file", fileName))
+		return nil
+	}
+
+	file, err := createBatchFile(fileName)
+	s.mutex.Lock()
+	s.files[batch] = file
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Receiving stream", zap.String("file", fileName))
+	return nil
+}
+
+func (s *RawFileSink) Write(batch *Batch, data []byte) error {
+	s.mutex.Lock()
+	file := s.files[batch]
+	s.mutex.Unlock()
+	if file == nil {
+		return nil
+	}
+	return file.Write(data)
+}
+
+// EndBatch commits a finished batch, failing if it couldn't be made durable, and quarantines an abandoned one.
+func (s *RawFileSink) EndBatch(batch *Batch, finished bool) error {
+	s.mutex.Lock()
+	file, started := s.files[batch]
+	delete(s.files, batch)
+	s.mutex.Unlock()
+	if !started {
+		// not saving this one
+		return nil
+	}
+	if file == nil {
+		if finished {
+			return errBatchNotCreated
+		}
+		return nil
+	}
+
+	if !finished {
+		destination, err := file.Quarantine()
+		if err != nil {
+			return err
+		}
+		quarantinedBatchesTotal.Inc()
+		s.logger.Warn("Quarantined partial batch", zap.String("batch_id", batch.Name), zap.String("file", destination))
+		return nil
+	}
+
+	err := file.Commit()
+	if err != nil {
+		return err
+	}
+	batch.Saved = true
+	if s.compress {
+		go s.compressFile(file.path)
+	}
+	return nil
+}
+
+func (s *RawFileSink) compressFile(path string) {
+	err := compressBatch(path)
+	if err != nil {
+		s.logger.Error("Error compressing batch", zap.String("file", path), zap.Error(err))
+	}
+}
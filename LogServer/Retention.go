@@ -0,0 +1,168 @@
+package LogServer
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const retentionInterval = 10 * time.Minute
+
+// errFreeSpaceUnknown is returned by freeSpace where there's no way to ask, see Retention_unix.go.
+var errFreeSpaceUnknown = errors.New("free space can't be checked on this platform")
+
+// RetentionPolicy limits how much the saved log stream can take up.  Zero values mean no limit.
+type RetentionPolicy struct {
+	MaxAge       time.Duration
+	MaxTotalSize int64 // bytes, across every pod
+	MaxFiles     int
+	Compress     bool   // gzip each batch once it is saved
+	MinFreeBytes uint64 // stop saving, while still acking, below this much free space
+}
+
+type savedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// hasSpace reports whether the filesystem holding path has at least minFree bytes free, assuming it has when it
+// can't tell.
+func hasSpace(path string, minFree uint64) (bool, error) {
+	if minFree == 0 {
+		return true, nil
+	}
+	free, err := freeSpace(path)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	diskFreeBytes.Set(float64(free))
+	return free >= minFree, nil
+}
+
+// compressBatch gzips a saved batch to <name>.RAW.gz, removing the original once the compressed copy is on disk.
+func compressBatch(path string) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+
+	output, err := os.Create(path + ".gz" + tempSuffix)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(output)
+	_, err = io.Copy(writer, input)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz" + tempSuffix)
+		return err
+	}
+	err = os.Rename(path+".gz"+tempSuffix, path+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeCompressionLeftovers deletes half written .gz files from a crash, the batches they came from are still there.
+func removeCompressionLeftovers(root string) {
+	matches, _ := filepath.Glob(filepath.Join(root, "*", "*.RAW.gz"+tempSuffix))
+	for _, match := range matches {
+		_ = os.Remove(match)
+	}
+}
+
+// savedFiles lists every saved batch, partial ones included, oldest first.
+func (b *LogServer) savedFiles() ([]savedFile, error) {
+	var files []savedFile
+	err := filepath.Walk(b.filePath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed since the folder was listed, e.g. renamed by compressBatch, or nothing has been saved yet
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !(strings.HasSuffix(name, ".RAW") || strings.HasSuffix(name, ".RAW.gz")) {
+			return nil
+		}
+		files = append(files, savedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, err
+}
+
+// applyRetention deletes the oldest batches until the saved files are within the policy.
+func (b *LogServer) applyRetention(now time.Time) {
+	files, err := b.savedFiles()
+	if err != nil {
+		b.logger.Error("Error listing saved batches", zap.Error(err))
+		return
+	}
+	var totalSize int64
+	for _, file := range files {
+		totalSize += file.size
+	}
+
+	policy := b.retention
+	for len(files) > 0 {
+		oldest := files[0]
+		expired := policy.MaxAge > 0 && now.Sub(oldest.modTime) > policy.MaxAge
+		tooBig := policy.MaxTotalSize > 0 && totalSize > policy.MaxTotalSize
+		tooMany := policy.MaxFiles > 0 && len(files) > policy.MaxFiles
+		if !expired && !tooBig && !tooMany {
+			break
+		}
+		err := os.Remove(oldest.path)
+		if err != nil && !os.IsNotExist(err) {
+			b.logger.Error("Error removing old batch", zap.String("file", oldest.path), zap.Error(err))
+			return
+		}
+		filesDeletedTotal.Inc()
+		b.logger.Info("Removed old batch", zap.String("file", oldest.path), zap.Bool("expired", expired),
+			zap.Bool("over_size", tooBig), zap.Bool("over_count", tooMany))
+		totalSize -= oldest.size
+		files = files[1:]
+	}
+	savedBytes.Set(float64(totalSize))
+}
+
+func (b *LogServer) runRetention() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		b.applyRetention(time.Now())
+		_, err := hasSpace(b.filePath, b.retention.MinFreeBytes)
+		if err != nil {
+			b.logger.Error("Error checking free space", zap.Error(err))
+		}
+		<-ticker.C
+	}
+}
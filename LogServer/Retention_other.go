@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package LogServer
+
+// freeSpace can't be checked here, so LOG_MIN_FREE_MB doesn't apply.
+func freeSpace(string) (uint64, error) {
+	return 0, errFreeSpaceUnknown
+}
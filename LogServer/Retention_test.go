@@ -0,0 +1,175 @@
+package LogServer
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Date(2024, time.March, 12, 12, 0, 0, 0, time.UTC)
+	// oldest first, a day apart, 100 bytes each
+	saved := []string{
+		"pod/partial/00000001.20240305T120000.123.RAW",
+		"pod/00000002.RAW.gz",
+		"pod/00000003.RAW",
+		"other/00000001.RAW",
+		"pod/00000004.RAW",
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		kept   int // the newest this many
+	}{
+		{"no limits", RetentionPolicy{}, 5},
+		{"max age", RetentionPolicy{MaxAge: 3*24*time.Hour + time.Hour}, 3},
+		{"max total size", RetentionPolicy{MaxTotalSize: 250}, 2},
+		{"max files", RetentionPolicy{MaxFiles: 3}, 3},
+		{"tightest limit wins", RetentionPolicy{MaxAge: 10 * 24 * time.Hour, MaxTotalSize: 1000, MaxFiles: 1}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for i, name := range saved {
+				path := filepath.Join(root, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := now.Add(-time.Duration(len(saved)-i) * 24 * time.Hour)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// not batches, whatever their age
+			others := []string{"batches.jsonl", "pod/notes.txt", "pod/00000005.RAW.1.tmp"}
+			for _, name := range others {
+				if err := os.WriteFile(filepath.Join(root, name), make([]byte, 1000), 0644); err != nil {
+					t.Fatal(err)
+				}
+				old := now.Add(-365 * 24 * time.Hour)
+				if err := os.Chtimes(filepath.Join(root, name), old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			server := &LogServer{filePath: root, retention: test.policy, logger: zap.NewNop()}
+			server.applyRetention(now)
+
+			var left []string
+			err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					name, _ := filepath.Rel(root, path)
+					left = append(left, filepath.ToSlash(name))
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(append([]string{}, others...), saved[len(saved)-test.kept:]...)
+			sort.Strings(left)
+			sort.Strings(want)
+			if strings.Join(left, ", ") != strings.Join(want, ", ") {
+				t.Errorf("left %v, want %v", left, want)
+			}
+		})
+	}
+}
+
+func TestApplyRetentionBeforeAnythingIsSaved(t *testing.T) {
+	server := &LogServer{
+		filePath:  filepath.Join(t.TempDir(), "missing"),
+		retention: RetentionPolicy{MaxFiles: 1},
+		logger:    zap.NewNop(),
+	}
+	files, err := server.savedFiles()
+	if err != nil || len(files) != 0 {
+		t.Errorf("got %v %v, want nothing saved and no error", files, err)
+	}
+	server.applyRetention(time.Now())
+}
+
+func TestCompressBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "00000001.RAW")
+	data := []byte(strings.Repeat("log stream ", 1000))
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = compressBatch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(path) || fileExists(path+".gz"+tempSuffix) {
+		t.Error("original or temporary file left behind")
+	}
+	file, err := os.Open(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != string(data) {
+		t.Error("decompressed batch doesn't match the original")
+	}
+}
+
+func TestCompressMissingBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "00000001.RAW")
+	err := compressBatch(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist", err)
+	}
+	if fileExists(path+".gz") || fileExists(path+".gz"+tempSuffix) {
+		t.Error("compressed file created without a batch")
+	}
+}
+
+func TestHasSpace(t *testing.T) {
+	dir := t.TempDir()
+	if enough, err := hasSpace(dir, 0); !enough || err != nil {
+		t.Errorf("got %t %v without a minimum, want space", enough, err)
+	}
+	if enough, err := hasSpace(dir, 1); !enough || err != nil {
+		t.Errorf("got %t %v for a byte, want space", enough, err)
+	}
+
+	_, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		// assumed to have space, however much is asked for
+		if enough, err := hasSpace(dir, math.MaxUint64); !enough || err != nil {
+			t.Errorf("got %t %v where free space can't be checked, want space", enough, err)
+		}
+		return
+	}
+	if enough, err := hasSpace(dir, math.MaxUint64); enough || err != nil {
+		t.Errorf("got %t %v for more space than any disk has, want not enough", enough, err)
+	}
+	// can't tell, so carries on saving
+	if enough, err := hasSpace(filepath.Join(dir, "missing"), 1); !enough || err == nil {
+		t.Errorf("got %t %v for a missing folder, want space and the error", enough, err)
+	}
+}
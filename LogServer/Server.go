@@ -1,32 +1,94 @@
 package LogServer
 
 import (
-	"bufio"
-	"encoding/binary"
 	"fmt"
 	"net"
-	"os"
-	"strings"
+	"path/filepath"
+	"sync"
 
 	"github.com/fxamacker/cbor/v2"
 	"go.uber.org/zap"
 )
 
 type LogServer struct {
-	state     state
-	saveFiles bool
-	filePath  string
-	logger    *zap.Logger
+	filePath      string
+	maxBufferSize int
+	retention     RetentionPolicy
+	indexPath     string // set once an index has been asked for, even if it couldn't be opened
+	indexEntries  int
+	indexFileSize int64
+	index         *BatchIndex  // nil if it couldn't be opened, batches then go unindexed
+	rawSink       *RawFileSink // nil when not saving the stream
+	sinks         fanOut
+	sessions      map[string]*Session // by device id, once the pod has said who it is
+	ackedBatches  map[string][]uint32 // the last few batches acked per device, to spot resends
+	mutex         sync.Mutex
+	logger        *zap.Logger
 }
 
-func (b LogServer) StartServer(saveFiles bool, filePath string, port int) {
+// SetMaxBufferSize sets how far each connection's buffer can grow, must be called before StartServer.
+func (b *LogServer) SetMaxBufferSize(size int) {
+	b.maxBufferSize = size
+}
+
+// SetRetention sets how long saved batches are kept and how much space they may use, must be called before
+// StartServer.
+func (b *LogServer) SetRetention(policy RetentionPolicy) {
+	b.retention = policy
+}
+
+// SetIndexLimits sets how many batch index entries are kept in memory and how big the file gets before it is rotated,
+// must be called before SetIndexPath.
+func (b *LogServer) SetIndexLimits(entries int, fileSize int64) {
+	b.indexEntries = entries
+	b.indexFileSize = fileSize
+}
+
+// SetIndexPath opens the batch index, by default batches.jsonl in the log folder.  Must be called before StartServer.
+// If it fails the server runs without an index.
+func (b *LogServer) SetIndexPath(path string) error {
+	logger, _ := zap.NewProduction()
+	b.indexPath = path
+	index, err := NewBatchIndex(path, b.indexEntries, b.indexFileSize, logger)
+	if err != nil {
+		return err
+	}
+	b.index = index
+	return nil
+}
+
+// Index returns the record of the batches received, nil if there's no index.
+func (b *LogServer) Index() *BatchIndex {
+	return b.index
+}
+
+func (b *LogServer) StartServer(saveFiles bool, filePath string, port int) {
 	logger, _ := zap.NewProduction()
 	b.logger = logger
-	b.state = StateClientHello
-	b.saveFiles = saveFiles
 	b.filePath = filePath
+	b.sessions = make(map[string]*Session)
+	b.ackedBatches = make(map[string][]uint32)
 
 	b.logger.Info("Starting LogBlackhole server", zap.Int("port", port))
+	if saveFiles {
+		rawSink, err := NewRawFileSink(filePath, b.retention)
+		if err != nil {
+			b.logger.Panic("Failed to create log folder", zap.String("path", filePath), zap.Error(err))
+		}
+		b.rawSink = rawSink
+		// the raw file goes first, so the tail only shows a batch once saving it has started
+		b.sinks.sinks = append([]LogSink{rawSink}, b.sinks.sinks...)
+	}
+	b.sinks.logger = logger
+	if b.indexPath == "" {
+		err := b.SetIndexPath(filepath.Join(filePath, "batches.jsonl"))
+		if err != nil {
+			b.logger.Error("Failed to open batch index, batches won't be indexed", zap.Error(err))
+		}
+	}
+	if saveFiles {
+		go b.runRetention()
+	}
 	portStr := fmt.Sprintf(":%d", port)
 	l, err := net.Listen("tcp4", portStr)
 	if err != nil {
@@ -42,145 +104,66 @@ func (b LogServer) StartServer(saveFiles bool, filePath string, port int) {
 			b.logger.Error("Failed to accept connection", zap.Error(err))
 			return
 		}
-		b.handleConnection(c)
-		b.state = StateClientHello
-		b.logger.Info("Client disconnected, waiting for new connection...")
+		go b.handleConnection(c)
 	}
 }
 
-func (b LogServer) handleConnection(c net.Conn) {
+func (b *LogServer) handleConnection(c net.Conn) {
 	b.logger.Info("Client connected", zap.String("remote_addr", c.RemoteAddr().String()))
-	defer func(c net.Conn) {
-		_ = c.Close()
-	}(c)
-
-	parser := StreamParser{}
-	buf := make([]byte, 4096)
-	var batchId uint32
-	var osFile *os.File
-	var file *bufio.Writer
-	var counter uint64 = 0
-	for {
-		n, err := c.Read(buf)
-		if err != nil {
-			b.logger.Info("Client disconnected", zap.String("remote_addr", c.RemoteAddr().String()))
-			if b.saveFiles && osFile != nil {
-				err := file.Flush()
-				if err != nil {
-					b.logger.Error("Error flushing file", zap.Error(err))
-				}
-				err = osFile.Close()
-				if err != nil {
-					b.logger.Error("Error closing file", zap.Error(err))
-				}
-				b.logger.Info("Closed open file due to client disconnect.")
-			}
-			return
-		}
-		data := buf[:n]
-
-		if b.state == StateClientHello {
-			var req WelcomeMessage
-			err := cbor.Unmarshal(data, &req)
-			if err != nil {
-				b.logger.Error("Error unmarshalling welcome message", zap.Error(err))
-				continue
-			}
-			res := WelcomeResponse{
-				Proto: "raw",
-				Part:  "session",
-			}
-			handshakeResponse, err := cbor.Marshal(res)
-			if err != nil {
-				b.logger.Error("Error marshalling handshake response", zap.Error(err))
-				return
-			}
-			_, err = c.Write(handshakeResponse)
-			if err != nil {
-				b.logger.Error("Error sending handshake response", zap.Error(err))
-				return
-			}
-			b.logger.Info("Device Connected", zap.String("device_id", req.DeviceId))
-			b.state = StateWaitingForStreamStart
-			continue
-		} else if b.state == StateWaitingForStreamStart {
-			/*
-				we parse this manually to avoid having to deal with indefinite cbor byte strings
-			*/
-			stringVersion := string(data)
-			if len(data) != 38 || !strings.Contains(stringVersion, "eprotocrawdpartebatchbid") {
-				b.logger.Error("Invalid batch start packet received")
-				continue
-			}
-			batchIdBytes := data[0x1a:0x1e]
-			batchId = binary.BigEndian.Uint32(batchIdBytes)
-			batchIdHex := fmt.Sprintf("%08X", batchId)
-			b.logger.Info("Batch Start", zap.String("batch_id", batchIdHex))
-			fileName := fmt.Sprintf("%s/%08X.RAW", b.filePath, batchId)
-			if b.saveFiles {
-				// open file for writing
-				osFile, err = os.Create(fileName)
-				if err != nil {
-					b.logger.Error("Error creating file", zap.Error(err))
-					return
-				}
-				file = bufio.NewWriter(osFile)
-				b.logger.Info("Receiving stream", zap.String("file", fileName))
-			} else {
-				b.logger.Info("Receiving stream (not saving)", zap.String("file", fileName))
-			}
-
-			b.state = StateReceivingStream
-			continue
-		} else if b.state == StateReceivingStream {
-			parser.Insert(data)
-			result := parser.ExtractCBORByteStrings()
-			for _, record := range result.Data {
-				counter += uint64(len(record))
-				if b.saveFiles {
-					// dump the data into the file
-					//fmt.Printf("Adding %d bytes to file\n", len(record))
-					_, err := file.Write(record)
-					if err != nil {
-						b.logger.Error("Error writing to file", zap.Error(err))
-					}
-					err = file.Flush()
-					if err != nil {
-						b.logger.Error("Error flushing file", zap.Error(err))
-					}
-				}
-			}
-			if result.ResetFound {
-				if b.saveFiles {
-					// close the file
-					err := file.Flush()
-					if err != nil {
-						b.logger.Error("Error flushing file", zap.Error(err))
-					}
-					err = osFile.Close()
-					if err != nil {
-						b.logger.Error("Error closing file", zap.Error(err))
-					}
-				}
-
-				ack := b.getFileAck(batchId)
-				_, err = c.Write(ack)
-				if err != nil {
-					b.logger.Error("Error sending ack", zap.Error(err))
-				}
-				counter = 0
-				b.state = StateWaitingForStreamStart
-				// convert to hex string
-
-				batchIdHex := fmt.Sprintf("%08X", batchId)
-				b.logger.Info("Stream finished", zap.String("batch_id", batchIdHex), zap.Uint64("bytes_received", counter))
-			}
-			continue
+	logConnectionsTotal.Inc()
+	session := newSession(b, c)
+	session.run() // blocking call
+	b.removeSession(session)
+	b.logger.Info("Client disconnected", zap.String("remote_addr", c.RemoteAddr().String()))
+}
+
+// registerSession records which pod a session belongs to.  A pod only streams over one connection at a time, so an
+// older session for the same pod is a socket that hung without us noticing, and is closed.
+func (b *LogServer) registerSession(session *Session) {
+	b.mutex.Lock()
+	previous := b.sessions[session.deviceId]
+	b.sessions[session.deviceId] = session
+	b.mutex.Unlock()
+
+	if previous != nil && previous != session {
+		b.logger.Warn("Pod reconnected, closing its previous log connection", zap.String("device_id", session.deviceId))
+		previous.close()
+	}
+}
+
+func (b *LogServer) removeSession(session *Session) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.sessions[session.deviceId] == session {
+		delete(b.sessions, session.deviceId)
+	}
+}
+
+// rememberedBatches is how many acked batch ids are kept per device.
+const rememberedBatches = 64
+
+func (b *LogServer) rememberBatch(deviceId string, batchId uint32) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	acked := append(b.ackedBatches[deviceId], batchId)
+	if len(acked) > rememberedBatches {
+		acked = acked[len(acked)-rememberedBatches:]
+	}
+	b.ackedBatches[deviceId] = acked
+}
+
+func (b *LogServer) batchAcked(deviceId string, batchId uint32) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, acked := range b.ackedBatches[deviceId] {
+		if acked == batchId {
+			return true
 		}
 	}
+	return false
 }
 
-func (b LogServer) getFileAck(batchId uint32) []byte {
+func (b *LogServer) getFileAck(batchId uint32) []byte {
 	res := FileAckResponse{
 		Proto: "raw",
 		Part:  "batch",
@@ -0,0 +1,244 @@
+package LogServer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.uber.org/zap"
+)
+
+// unknownDeviceId is where batches from a pod that didn't say who it is go.
+const unknownDeviceId = "unknown"
+
+// validDeviceId reports whether id looks like a pod's device id, the 12 byte stm32 unique id in hex.  The id names the
+// pod's log folder, so anything else is ignored.
+func validDeviceId(id string) bool {
+	if len(id) != hex.EncodedLen(12) {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Session is one pod's log connection, with its own protocol state, parser and current batch.
+type Session struct {
+	server    *LogServer
+	conn      net.Conn
+	state     state
+	parser    *StreamParser
+	deviceId  string
+	batch     *Batch // while receiving a stream
+	duplicate bool   // a batch we already have, received but not given to the sinks again
+	counter   uint64
+	logger    *zap.Logger
+}
+
+func newSession(server *LogServer, conn net.Conn) *Session {
+	return &Session{
+		server:   server,
+		conn:     conn,
+		state:    StateClientHello,
+		parser:   NewStreamParser(server.maxBufferSize),
+		deviceId: unknownDeviceId,
+		logger:   server.logger.With(zap.String("remote_addr", conn.RemoteAddr().String())),
+	}
+}
+
+func (s *Session) close() {
+	_ = s.conn.Close()
+}
+
+func (s *Session) run() {
+	defer s.close()
+
+	for {
+		// frames are handled before reading any more, so a slow disk holds the pod up rather than losing data
+		_, err := s.parser.ReadOnce(s.conn)
+		if errors.Is(err, ErrBufferFull) {
+			// can't happen while frames bigger than the buffer are skipped, but don't spin if it does
+			s.logger.Error("Log stream buffer full without a complete frame, dropping connection")
+		}
+		if err != nil {
+			s.logger.Info("Client disconnected")
+			if s.state == StateReceivingStream {
+				s.endBatch(false)
+			}
+			return
+		}
+
+		for {
+			frame, ok := s.parser.Next()
+			if !ok {
+				break
+			}
+			if !s.handleFrame(frame) {
+				return
+			}
+		}
+		skipped := s.parser.Skipped()
+		if skipped > 0 {
+			bytesSkippedTotal.Add(float64(skipped))
+			s.logger.Warn("Skipped bytes that weren't part of any frame", zap.Int("bytes", skipped))
+		}
+	}
+}
+
+// handleFrame acts on a frame whatever state the session is in, as the pod doesn't always send the welcome and
+// batch start.  Returns false if the connection should be dropped.
+func (s *Session) handleFrame(frame Frame) bool {
+	switch frame.Type {
+	case FrameWelcome:
+		if s.state == StateReceivingStream {
+			s.logger.Warn("Welcome received mid batch, abandoning batch", zap.String("batch_id", s.batch.Name))
+			s.endBatch(false)
+		}
+		return s.handleWelcome(frame.Welcome)
+	case FrameBatchStart:
+		if s.state == StateReceivingStream {
+			s.logger.Warn("Batch start received mid batch, abandoning batch", zap.String("batch_id", s.batch.Name))
+			s.endBatch(false)
+		}
+		s.startBatch(frame.BatchId, true)
+	case FrameData:
+		if s.state != StateReceivingStream {
+			s.logger.Warn("Data received without a batch start")
+			s.startBatch(0, false)
+		}
+		s.handleData(frame.Data)
+	case FrameBatchEnd:
+		if s.state == StateReceivingStream {
+			s.endBatch(true)
+		}
+	}
+	return true
+}
+
+func (s *Session) handleWelcome(req WelcomeMessage) bool {
+	res := WelcomeResponse{
+		Proto: "raw",
+		Part:  "session",
+	}
+	handshakeResponse, err := cbor.Marshal(res)
+	if err != nil {
+		s.logger.Error("Error marshalling handshake response", zap.Error(err))
+		return false
+	}
+	_, err = s.conn.Write(handshakeResponse)
+	if err != nil {
+		s.logger.Error("Error sending handshake response", zap.Error(err))
+		return false
+	}
+	s.logger.Info("Device Connected", zap.String("device_id", req.DeviceId))
+	if validDeviceId(req.DeviceId) {
+		s.deviceId = req.DeviceId
+		s.logger = s.logger.With(zap.String("device_id", req.DeviceId))
+		s.server.registerSession(s)
+	} else {
+		// without an id there's no telling whether another unknown connection is the same pod
+		s.logger.Warn("Welcome without a valid device id", zap.String("device_id", req.DeviceId))
+	}
+	s.state = StateWaitingForStreamStart
+	return true
+}
+
+// batchName is the batch id in hex, or a name made up from the time for a batch the pod didn't announce.
+func batchName(batchId uint32, hasBatchId bool, started time.Time) string {
+	if !hasBatchId {
+		return started.UTC().Format("unannounced-20060102T150405")
+	}
+	return fmt.Sprintf("%08X", batchId)
+}
+
+func (s *Session) startBatch(batchId uint32, hasBatchId bool) {
+	started := time.Now()
+	s.batch = &Batch{
+		DeviceId: s.deviceId,
+		Id:       batchId,
+		HasId:    hasBatchId,
+		Name:     batchName(batchId, hasBatchId, started),
+		Started:  started,
+	}
+	s.duplicate = false
+	s.logger.Info("Batch Start", zap.String("batch_id", s.batch.Name))
+
+	// the pod resends a batch if it missed our ack, there's nothing new in it.  Batch ids are only unique per pod, so
+	// a pod that didn't say who it is can't be checked.
+	rawSink := s.server.rawSink
+	if hasBatchId && s.deviceId != unknownDeviceId && (s.server.batchAcked(s.deviceId, batchId) || (rawSink != nil && rawSink.Has(s.deviceId, s.batch.Name))) {
+		duplicateBatchesTotal.Inc()
+		s.logger.Info("Batch already received, acking without saving", zap.String("batch_id", s.batch.Name))
+		s.duplicate = true
+	} else {
+		s.server.sinks.StartBatch(s.batch)
+	}
+	s.state = StateReceivingStream
+}
+
+func (s *Session) handleData(data []byte) {
+	s.counter += uint64(len(data))
+	bytesReceivedTotal.Add(float64(len(data)))
+	if s.duplicate {
+		return
+	}
+	s.server.sinks.Write(s.batch, data)
+}
+
+// endBatch finishes the batch.  A finished batch is acked once every sink has kept it, if the pod told us its id.
+// One the pod abandoned isn't acked, so the pod sends it again.
+func (s *Session) endBatch(finished bool) {
+	var err error
+	if !s.duplicate {
+		err = s.server.sinks.EndBatch(s.batch, finished)
+	}
+	status := BatchReceived
+	switch {
+	case !finished:
+		status = BatchPartial
+	case s.duplicate:
+		status = BatchDuplicate
+	case err != nil:
+		// without the ack the pod will send the batch again
+		s.logger.Error("Error saving batch, not acking", zap.String("batch_id", s.batch.Name), zap.Error(err))
+		finished = false
+		status = BatchFailed
+	case s.batch.Saved:
+		status = BatchSaved
+	}
+
+	acked := finished && s.batch.HasId
+	if acked {
+		batchesReceivedTotal.Inc()
+		ack := s.server.getFileAck(s.batch.Id)
+		_, err := s.conn.Write(ack)
+		if err != nil {
+			s.logger.Error("Error sending ack", zap.Error(err))
+		}
+		s.server.rememberBatch(s.deviceId, s.batch.Id)
+	}
+	s.logger.Info("Stream finished", zap.String("batch_id", s.batch.Name), zap.Uint64("bytes_received", s.counter), zap.Bool("finished", finished))
+
+	entry := BatchEntry{
+		DeviceId: s.deviceId,
+		Start:    s.batch.Started,
+		End:      time.Now(),
+		Bytes:    s.counter,
+		Acked:    acked,
+		Status:   status,
+	}
+	if s.batch.HasId {
+		batchId := s.batch.Id
+		entry.BatchId = &batchId
+	}
+	if s.server.index != nil {
+		s.server.index.Add(entry)
+	}
+
+	s.batch = nil
+	s.counter = 0
+	s.duplicate = false
+	s.state = StateWaitingForStreamStart
+}
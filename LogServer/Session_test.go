@@ -0,0 +1,197 @@
+package LogServer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.uber.org/zap"
+)
+
+// newTestServer sets up a LogServer saving raw batches to a temporary folder, as StartServer would, and serves
+// connections to it on a loopback port.
+func newTestServer(t *testing.T) (*LogServer, string) {
+	t.Helper()
+	path := t.TempDir()
+	rawSink, err := NewRawFileSink(path, RetentionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &LogServer{
+		filePath:     path,
+		rawSink:      rawSink,
+		sinks:        fanOut{sinks: []LogSink{rawSink}, logger: zap.NewNop()},
+		sessions:     make(map[string]*Session),
+		ackedBatches: make(map[string][]uint32),
+		logger:       zap.NewNop(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+type testPod struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder *cbor.Decoder
+}
+
+func connectPod(t *testing.T, address string, deviceId string) *testPod {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	pod := &testPod{t: t, conn: conn, decoder: cbor.NewDecoder(conn)}
+	welcome, err := cbor.Marshal(WelcomeMessage{Proto: "raw", Part: "session", DeviceId: deviceId, Version: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.send(welcome)
+	var response WelcomeResponse
+	pod.receive(&response)
+	if response.Part != "session" {
+		t.Fatalf("got welcome response %+v", response)
+	}
+	return pod
+}
+
+func (p *testPod) send(data []byte) {
+	p.t.Helper()
+	_, err := p.conn.Write(data)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPod) receive(v interface{}) {
+	p.t.Helper()
+	_ = p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := p.decoder.Decode(v)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPod) startBatch(batchId uint32) {
+	start := append([]byte{}, batchStartFrame...)
+	binary.BigEndian.PutUint32(start[bytes.Index(start, []byte{0x1a})+1:], batchId)
+	p.send(start)
+}
+
+func (p *testPod) sendData(data []byte) {
+	p.send(append([]byte{0x58, byte(len(data))}, data...))
+}
+
+func (p *testPod) endBatch(batchId uint32) {
+	p.t.Helper()
+	p.send([]byte{0xff})
+	var ack FileAckResponse
+	p.receive(&ack)
+	if ack.Part != "batch" || ack.Id != batchId {
+		p.t.Fatalf("got ack %+v, want batch %d", ack, batchId)
+	}
+}
+
+func readBatch(t *testing.T, path string, deviceId string, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(path, deviceId, name+".RAW"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+const (
+	firstPodId  = "00112233445566778899aabb"
+	secondPodId = "0a0b0c0d0e0f000102030405"
+)
+
+func TestSessionsRunConcurrently(t *testing.T) {
+	server, address := newTestServer(t)
+
+	first := connectPod(t, address, firstPodId)
+	first.startBatch(1)
+	first.sendData([]byte("first half, "))
+
+	// the first pod is mid batch, the second shouldn't have to wait for it
+	second := connectPod(t, address, secondPodId)
+	second.startBatch(1)
+	second.sendData([]byte("second"))
+	second.endBatch(1)
+
+	first.sendData([]byte("second half"))
+	first.endBatch(1)
+
+	if got := readBatch(t, server.filePath, firstPodId, "00000001"); got != "first half, second half" {
+		t.Errorf("first pod's batch is %q", got)
+	}
+	if got := readBatch(t, server.filePath, secondPodId, "00000001"); got != "second" {
+		t.Errorf("second pod's batch is %q", got)
+	}
+}
+
+func TestReconnectClosesThePreviousSession(t *testing.T) {
+	server, address := newTestServer(t)
+
+	hung := connectPod(t, address, firstPodId)
+	hung.startBatch(1)
+	hung.sendData([]byte("cut short"))
+
+	pod := connectPod(t, address, firstPodId)
+	_ = hung.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := hung.conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("the previous connection is still open")
+	}
+
+	// the cut short batch wasn't acked, so the pod sends it again
+	pod.startBatch(1)
+	pod.sendData([]byte("whole"))
+	pod.endBatch(1)
+	if got := readBatch(t, server.filePath, firstPodId, "00000001"); got != "whole" {
+		t.Errorf("batch is %q", got)
+	}
+}
+
+func TestPodsWithoutAValidIdDontCloseEachOther(t *testing.T) {
+	server, address := newTestServer(t)
+
+	for _, deviceId := range []string{"", "../etc", "0011"} {
+		first := connectPod(t, address, deviceId)
+		second := connectPod(t, address, deviceId)
+		first.startBatch(1)
+		first.sendData([]byte("first"))
+		first.endBatch(1)
+		// the same batch id from another unknown pod isn't taken for a resend
+		second.startBatch(1)
+		second.sendData([]byte("second"))
+		second.endBatch(1)
+		if got := readBatch(t, server.filePath, unknownDeviceId, "00000001"); got != "second" {
+			t.Errorf("%q: batch is %q", deviceId, got)
+		}
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.sessions) != 0 {
+		t.Errorf("registered sessions for pods without an id: %v", server.sessions)
+	}
+}
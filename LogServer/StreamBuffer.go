@@ -0,0 +1,129 @@
+package LogServer
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	initialBufferSize = 8 * 1024 // 8KB
+	defaultMaxBuffer  = 4 * 1024 * 1024
+	minReadSize       = 4096
+)
+
+var ErrBufferFull = errors.New("stream buffer full")
+
+// StreamBuffer holds the bytes read from the pod that haven't been decoded yet.  It grows as needed up to maxSize,
+// and hands out slices of itself rather than copies: anything returned by Peek or Bytes is only valid until the next
+// Write or ReadOnce.
+type StreamBuffer struct {
+	buf     []byte
+	start   int // first unread byte
+	end     int // one past the last unread byte
+	maxSize int
+}
+
+func NewStreamBuffer(maxSize int) *StreamBuffer {
+	if maxSize <= 0 {
+		maxSize = defaultMaxBuffer
+	}
+	size := initialBufferSize
+	if size > maxSize {
+		size = maxSize
+	}
+	return &StreamBuffer{buf: make([]byte, size), maxSize: maxSize}
+}
+
+// MaxSize is the most the buffer will hold, and so the largest frame it can decode.
+func (b *StreamBuffer) MaxSize() int {
+	return b.maxSize
+}
+
+// DataLen returns the number of bytes currently in the buffer.
+func (b *StreamBuffer) DataLen() int {
+	return b.end - b.start
+}
+
+// reserve makes room for at least n more bytes after end, moving the unread bytes to the front or growing the
+// buffer.
+func (b *StreamBuffer) reserve(n int) error {
+	if len(b.buf)-b.end >= n {
+		return nil
+	}
+	dataLen := b.DataLen()
+	if dataLen+n > b.maxSize {
+		return ErrBufferFull
+	}
+	if dataLen+n > len(b.buf) {
+		size := 2 * len(b.buf)
+		for size < dataLen+n {
+			size *= 2
+		}
+		if size > b.maxSize {
+			size = b.maxSize
+		}
+		grown := make([]byte, size)
+		copy(grown, b.buf[b.start:b.end])
+		b.buf = grown
+	} else {
+		copy(b.buf, b.buf[b.start:b.end])
+	}
+	b.start = 0
+	b.end = dataLen
+	return nil
+}
+
+// Write appends data to the buffer. Returns ErrBufferFull, having written nothing, if it would grow past maxSize.
+func (b *StreamBuffer) Write(data []byte) error {
+	err := b.reserve(len(data))
+	if err != nil {
+		return err
+	}
+	b.end += copy(b.buf[b.end:], data)
+	return nil
+}
+
+// ReadOnce does a single read from r straight into the buffer.  It returns ErrBufferFull without reading if the
+// buffer is full, leaving the data waiting in the socket rather than dropping it.
+func (b *StreamBuffer) ReadOnce(r io.Reader) (int, error) {
+	want := minReadSize
+	if free := b.maxSize - b.DataLen(); free < want {
+		want = free
+	}
+	if want == 0 {
+		return 0, ErrBufferFull
+	}
+	err := b.reserve(want)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.Read(b.buf[b.end:])
+	b.end += n
+	return n, err
+}
+
+// Bytes returns all of the unread bytes.
+func (b *StreamBuffer) Bytes() []byte {
+	return b.buf[b.start:b.end]
+}
+
+// Peek returns up to n bytes from the buffer without advancing.
+func (b *StreamBuffer) Peek(n int) []byte {
+	if n > b.DataLen() {
+		n = b.DataLen()
+	}
+	return b.buf[b.start : b.start+n]
+}
+
+// Advance discards the next n bytes.
+func (b *StreamBuffer) Advance(n int) {
+	if n > b.DataLen() {
+		n = b.DataLen()
+	}
+	b.start += n
+	if b.start == b.end {
+		// empty, start again from the front so reads don't need a copy to make room
+		b.start = 0
+		b.end = 0
+	}
+}
@@ -0,0 +1,307 @@
+package LogServer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// circularBuffer and circularStreamParser are the fixed 8KB buffer and parser StreamBuffer replaced, kept here to
+// benchmark against.
+const circularBufferSize = 8 * 1024
+
+type circularBuffer struct {
+	buf        [circularBufferSize]byte
+	readPos    int
+	writePos   int
+	dataLength int
+}
+
+func (cb *circularBuffer) Write(data []byte) error {
+	if len(data) > circularBufferSize-cb.dataLength {
+		return ErrBufferFull
+	}
+	for _, b := range data {
+		cb.buf[cb.writePos] = b
+		cb.writePos = (cb.writePos + 1) % circularBufferSize
+	}
+	cb.dataLength += len(data)
+	return nil
+}
+
+func (cb *circularBuffer) Peek(n int) []byte {
+	if n > cb.dataLength {
+		n = cb.dataLength
+	}
+	result := make([]byte, n)
+	for i := 0; i < n; i++ {
+		result[i] = cb.buf[(cb.readPos+i)%circularBufferSize]
+	}
+	return result
+}
+
+func (cb *circularBuffer) Advance(n int) {
+	if n > cb.dataLength {
+		n = cb.dataLength
+	}
+	cb.readPos = (cb.readPos + n) % circularBufferSize
+	cb.dataLength -= n
+}
+
+func (cb *circularBuffer) DataLen() int {
+	return cb.dataLength
+}
+
+type circularStreamParser struct {
+	cb circularBuffer
+}
+
+func (sp *circularStreamParser) Next() (Frame, bool) {
+	for sp.cb.DataLen() > 0 {
+		first := sp.cb.Peek(1)[0]
+		switch {
+		case first == 0xFF:
+			sp.cb.Advance(1)
+			return Frame{Type: FrameBatchEnd}, true
+		case first >= 0x40 && first <= 0x5B:
+			_, _, length, headLength, status := readHead(sp.cb.Peek(maxHeadLength))
+			if status == decodeNeedMore {
+				return Frame{}, false
+			}
+			if status == decodeInvalid || length > uint64(circularBufferSize-headLength) {
+				sp.cb.Advance(1)
+				continue
+			}
+			if sp.cb.DataLen() < headLength+int(length) {
+				return Frame{}, false
+			}
+			sp.cb.Advance(headLength)
+			data := sp.cb.Peek(int(length))
+			sp.cb.Advance(int(length))
+			return Frame{Type: FrameData, Data: data}, true
+		case first >= 0xA0 && first <= 0xBF:
+			frames, length, status := decodeMapFrame(sp.cb.Peek(sp.cb.DataLen()), circularBufferSize)
+			if status == decodeNeedMore {
+				return Frame{}, false
+			}
+			if status != decodeOk {
+				sp.cb.Advance(1)
+				continue
+			}
+			sp.cb.Advance(length)
+			return frames[0], true
+		default:
+			sp.cb.Advance(1)
+		}
+	}
+	return Frame{}, false
+}
+
+// the welcome and batch start from the wireshark dumps in the Readme, with the device id as the ascii it shows
+var (
+	// {"proto": "raw", "part": "session", "dev": "0123456789abcdef01234567", "version": "2"}
+	welcomeFrame = mustHex("a4" + "6570726f746f" + "63726177" + "6470617274" + "6773657373696f6e" + "63646576" +
+		"7818303132333435363738396162636465663031323334353637" + "6776657273696f6e" + "6132")
+	// {"proto": "raw", "part": "batch", "id": 0x00010203, "stream": (_
+	batchStartFrame = mustHex("a4" + "6570726f746f" + "63726177" + "6470617274" + "656261746368" + "626964" +
+		"1a00010203" + "6673747265616d" + "5f")
+)
+
+func mustHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// testBatch is a batch start, chunks data chunks of chunkSize bytes, and the batch end.
+func testBatch(chunks int, chunkSize int) []byte {
+	stream := append([]byte{}, batchStartFrame...)
+	for i := 0; i < chunks; i++ {
+		stream = append(stream, 0x59, byte(chunkSize>>8), byte(chunkSize))
+		stream = append(stream, bytes.Repeat([]byte{byte(i)}, chunkSize)...)
+	}
+	return append(stream, 0xFF)
+}
+
+func TestStreamBufferGrows(t *testing.T) {
+	b := NewStreamBuffer(64 * 1024)
+	data := bytes.Repeat([]byte{1}, 10*1024)
+	err := b.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.buf) != 16*1024 {
+		t.Errorf("grew to %d bytes, want %d", len(b.buf), 16*1024)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Error("data changed while growing")
+	}
+
+	// not past maxSize
+	b = NewStreamBuffer(12 * 1024)
+	err = b.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.buf) != 12*1024 {
+		t.Errorf("grew to %d bytes, want %d", len(b.buf), 12*1024)
+	}
+}
+
+func TestStreamBufferCompacts(t *testing.T) {
+	b := NewStreamBuffer(initialBufferSize)
+	err := b.Write(bytes.Repeat([]byte{1}, 6*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Advance(5 * 1024)
+	// only fits once the unread kilobyte is moved to the front
+	err = b.Write(bytes.Repeat([]byte{2}, 4*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.buf) != initialBufferSize || b.start != 0 {
+		t.Errorf("buffer is %d bytes starting at %d, want %d starting at 0", len(b.buf), b.start, initialBufferSize)
+	}
+	want := append(bytes.Repeat([]byte{1}, 1024), bytes.Repeat([]byte{2}, 4*1024)...)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Error("data changed while compacting")
+	}
+
+	b.Advance(b.DataLen())
+	if b.start != 0 || b.end != 0 {
+		t.Errorf("empty buffer left at %d-%d", b.start, b.end)
+	}
+}
+
+func TestStreamBufferFull(t *testing.T) {
+	b := NewStreamBuffer(initialBufferSize)
+	err := b.Write(make([]byte, initialBufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Write([]byte{1})
+	if !errors.Is(err, ErrBufferFull) {
+		t.Errorf("write got %v, want %v", err, ErrBufferFull)
+	}
+	if b.DataLen() != initialBufferSize {
+		t.Errorf("failed write changed the data length to %d", b.DataLen())
+	}
+
+	reader := strings.NewReader("waiting in the socket")
+	n, err := b.ReadOnce(reader)
+	if n != 0 || !errors.Is(err, ErrBufferFull) {
+		t.Errorf("read got %d, %v, want 0, %v", n, err, ErrBufferFull)
+	}
+	if reader.Len() != len("waiting in the socket") {
+		t.Error("a full buffer read from the socket")
+	}
+}
+
+func TestStreamParserOneByteAtATime(t *testing.T) {
+	stream := append(append([]byte{}, welcomeFrame...), testBatch(2, 20*1024)...)
+	sp := NewStreamParser(0)
+	reader := iotest.OneByteReader(bytes.NewReader(stream))
+
+	var frames []Frame
+	for {
+		_, err := sp.ReadOnce(reader)
+		for {
+			frame, ok := sp.Next()
+			if !ok {
+				break
+			}
+			if frame.Type == FrameData {
+				// only valid until the next read
+				frame.Data = []byte{frame.Data[0], byte(len(frame.Data) >> 8)}
+			}
+			frames = append(frames, frame)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if len(frames) != 5 {
+		t.Fatalf("got %d frames, want 5: %+v", len(frames), frames)
+	}
+	if frames[0].Type != FrameWelcome || frames[0].Welcome.Proto != "raw" || frames[0].Welcome.DeviceId != "0123456789abcdef01234567" || frames[0].Welcome.Version != "2" {
+		t.Errorf("got welcome %+v", frames[0])
+	}
+	if frames[1].Type != FrameBatchStart || frames[1].BatchId != 0x00010203 {
+		t.Errorf("got batch start %+v", frames[1])
+	}
+	for i, frame := range frames[2:4] {
+		// bigger than the old 8KB buffer could hold
+		if frame.Type != FrameData || frame.Data[0] != byte(i) || frame.Data[1] != 20*1024>>8 {
+			t.Errorf("got data frame %d %+v", i, frame)
+		}
+	}
+	if frames[4].Type != FrameBatchEnd {
+		t.Errorf("got batch end %+v", frames[4])
+	}
+	if sp.Skipped() != 0 {
+		t.Errorf("skipped %d bytes", sp.Skipped())
+	}
+}
+
+func BenchmarkStreamBuffer(b *testing.B) {
+	chunk := make([]byte, 1024)
+	b.Run("CircularBuffer", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		var cb circularBuffer
+		for i := 0; i < b.N; i++ {
+			_ = cb.Write(chunk)
+			_ = cb.Peek(len(chunk))
+			cb.Advance(len(chunk))
+		}
+	})
+	b.Run("StreamBuffer", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		sb := NewStreamBuffer(0)
+		for i := 0; i < b.N; i++ {
+			_ = sb.Write(chunk)
+			_ = sb.Peek(len(chunk))
+			sb.Advance(len(chunk))
+		}
+	})
+}
+
+func BenchmarkStreamParser(b *testing.B) {
+	// chunks the old buffer could hold, fed in as 4KB reads
+	stream := testBatch(64, 2*1024)
+	const readSize = 4096
+	b.Run("CircularBuffer", func(b *testing.B) {
+		b.SetBytes(int64(len(stream)))
+		var sp circularStreamParser
+		for i := 0; i < b.N; i++ {
+			for pos := 0; pos < len(stream); pos += readSize {
+				end := min(pos+readSize, len(stream))
+				if err := sp.cb.Write(stream[pos:end]); err != nil {
+					b.Fatal(err)
+				}
+				for _, ok := sp.Next(); ok; _, ok = sp.Next() {
+				}
+			}
+		}
+	})
+	b.Run("StreamBuffer", func(b *testing.B) {
+		b.SetBytes(int64(len(stream)))
+		sp := NewStreamParser(0)
+		for i := 0; i < b.N; i++ {
+			for pos := 0; pos < len(stream); pos += readSize {
+				end := min(pos+readSize, len(stream))
+				if err := sp.Insert(stream[pos:end]); err != nil {
+					b.Fatal(err)
+				}
+				for _, ok := sp.Next(); ok; _, ok = sp.Next() {
+				}
+			}
+		}
+	})
+}
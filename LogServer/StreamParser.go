@@ -1,86 +1,97 @@
 package LogServer
 
-// StreamParser wraps CircularBuffer and provides CBOR extraction utilities.
+import "io"
+
+// StreamParser wraps StreamBuffer and decodes the frames of the log protocol out of it.  The data in a frame is a
+// slice of the buffer, so it's only valid until the next Insert or ReadOnce, and every frame should be taken with
+// Next before either is called.
 type StreamParser struct {
-	cb CircularBuffer
+	cb      *StreamBuffer
+	pending []Frame // decoded together, a batch sent whole, and still to be returned
+	skipped int     // bytes thrown away since the last call to Skipped
 }
 
-// Insert adds data to the buffer. If data exceeds available space, it returns an error.
-func (sp *StreamParser) Insert(data []byte) {
-	_ = sp.cb.Write(data) // Overwrite error is ignored for compatibility
+func NewStreamParser(maxBufferSize int) *StreamParser {
+	return &StreamParser{cb: NewStreamBuffer(maxBufferSize)}
 }
 
-type CBORExtractResult struct {
-	Data       [][]byte // extracted data portions
-	ResetFound bool     // true if a reset code (0xFF) was encountered
+// Insert adds data to the buffer. Returns ErrBufferFull if it won't fit.
+func (sp *StreamParser) Insert(data []byte) error {
+	return sp.cb.Write(data)
 }
 
-// ExtractCBORByteStrings extracts as many CBOR byte strings as possible from the buffer.
-// Stops if a reset code (0xFF) is encountered or incomplete data is found.
-// Returns a CBORExtractResult with the extracted data and reset status.
-func (sp *StreamParser) ExtractCBORByteStrings() CBORExtractResult {
-	var results [][]byte
-	resetFound := false
-	for {
-		if sp.cb.DataLen() == 0 {
-			break
-		}
-		peek := sp.cb.Peek(1)
-		b := peek[0]
-		if b == 0xFF {
-			// Reset code encountered, clear buffer
-			sp.cb = CircularBuffer{}
-			resetFound = true
-			break
-		}
-		length, headerLen, ok := parseCBORByteStringHeaderCircular(&sp.cb)
-		if !ok {
-			break // incomplete header
-		}
-		totalLen := headerLen + length
-		if sp.cb.DataLen() < totalLen {
-			break // incomplete data
-		}
-		sp.cb.Advance(headerLen) // discard header
-		bs := sp.cb.Peek(length)
-		results = append(results, bs)
-		sp.cb.Advance(length)
-	}
-	return CBORExtractResult{Data: results, ResetFound: resetFound}
+// ReadOnce reads once from r into the buffer.
+func (sp *StreamParser) ReadOnce(r io.Reader) (int, error) {
+	return sp.cb.ReadOnce(r)
 }
 
-// parseCBORByteStringHeaderCircular parses the CBOR byte string header at the buffer head.
-// Returns (length, headerLen, ok). If not enough data, ok=false.
-func parseCBORByteStringHeaderCircular(cb *CircularBuffer) (int, int, bool) {
-	if cb.DataLen() < 1 {
-		return 0, 0, false
-	}
-	first := cb.Peek(1)[0]
-	if (first & 0xE0) != 0x40 {
-		return 0, 0, false // not a byte string
+// Skipped returns how many bytes didn't belong to any frame since it was last called.
+func (sp *StreamParser) Skipped() int {
+	skipped := sp.skipped
+	sp.skipped = 0
+	return skipped
+}
+
+// Next decodes the next complete frame in the buffer, returning false once more data is needed.  Bytes that can't
+// start a frame are skipped over until one can.
+func (sp *StreamParser) Next() (Frame, bool) {
+	if len(sp.pending) > 0 {
+		frame := sp.pending[0]
+		sp.pending = sp.pending[1:]
+		return frame, true
 	}
-	ai := first & 0x1F
-	switch {
-	case ai < 24:
-		return int(ai), 1, true
-	case ai == 24:
-		if cb.DataLen() < 2 {
-			return 0, 0, false
-		}
-		return int(cb.Peek(2)[1]), 2, true
-	case ai == 25:
-		if cb.DataLen() < 3 {
-			return 0, 0, false
-		}
-		peek := cb.Peek(3)
-		return int(peek[1])<<8 | int(peek[2]), 3, true
-	case ai == 26:
-		if cb.DataLen() < 5 {
-			return 0, 0, false
+	for sp.cb.DataLen() > 0 {
+		first := sp.cb.Peek(1)[0]
+		switch {
+		case first == 0xFF:
+			// the break ending a batch's byte string, or an unannounced batch
+			sp.cb.Advance(1)
+			return Frame{Type: FrameBatchEnd}, true
+
+		case first >= 0x40 && first <= 0x5B:
+			// definite length byte string, a chunk of data
+			_, _, length, headLength, status := readHead(sp.cb.Peek(maxHeadLength))
+			if status == decodeNeedMore {
+				return Frame{}, false
+			}
+			if status == decodeInvalid || length > uint64(sp.cb.MaxSize()-headLength) {
+				sp.skip()
+				continue
+			}
+			if sp.cb.DataLen() < headLength+int(length) {
+				return Frame{}, false
+			}
+			sp.cb.Advance(headLength)
+			data := sp.cb.Peek(int(length))
+			sp.cb.Advance(int(length))
+			return Frame{Type: FrameData, Data: data}, true
+
+		case first >= 0xA0 && first <= 0xBF:
+			// welcome or batch start, which also ends any batch the pod abandoned
+			frames, length, status := decodeMapFrame(sp.cb.Bytes(), sp.cb.MaxSize())
+			switch status {
+			case decodeNeedMore:
+				return Frame{}, false
+			case decodeInvalid:
+				sp.skip()
+				continue
+			case decodeUnknown:
+				sp.cb.Advance(length)
+				sp.skipped += length
+				continue
+			}
+			sp.cb.Advance(length)
+			sp.pending = frames[1:]
+			return frames[0], true
+
+		default:
+			sp.skip()
 		}
-		peek := cb.Peek(5)
-		return int(peek[1])<<24 | int(peek[2])<<16 | int(peek[3])<<8 | int(peek[4]), 5, true
-	default:
-		return 0, 0, false // indefinite or unsupported
 	}
+	return Frame{}, false
+}
+
+func (sp *StreamParser) skip() {
+	sp.cb.Advance(1)
+	sp.skipped++
 }
@@ -0,0 +1,179 @@
+package LogServer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// parseOneByteAtATime feeds stream to a parser a byte at a time, so every frame is split across reads, and describes
+// the frames it gets back.
+func parseOneByteAtATime(t *testing.T, stream []byte) ([]string, int) {
+	t.Helper()
+	sp := NewStreamParser(0)
+	var frames []string
+	skipped := 0
+	for _, b := range stream {
+		err := sp.Insert([]byte{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			frame, ok := sp.Next()
+			if !ok {
+				break
+			}
+			switch frame.Type {
+			case FrameWelcome:
+				frames = append(frames, "welcome "+frame.Welcome.DeviceId)
+			case FrameBatchStart:
+				frames = append(frames, fmt.Sprintf("start %08X", frame.BatchId))
+			case FrameData:
+				frames = append(frames, "data "+string(frame.Data))
+			case FrameBatchEnd:
+				frames = append(frames, "end")
+			}
+		}
+		skipped += sp.Skipped()
+	}
+	return frames, skipped
+}
+
+func checkFrames(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got frames %q, want %q", got, want)
+	}
+}
+
+func dataChunk(text string) []byte {
+	return append([]byte{0x40 + byte(len(text))}, text...)
+}
+
+func TestStreamParserSkipsGarbage(t *testing.T) {
+	garbage := []byte{0x00, 0x13, 0x37, 0xfe, 0x7f}
+	// well formed, but not something the pod sends, so skipped whole rather than picked through
+	unknown := mustHex("a2" + "6470617274" + "656f74686572" + "6178" + "82" + "44" + "68656c6c" + "01")
+
+	var stream []byte
+	stream = append(stream, garbage...)
+	stream = append(stream, unknown...)
+	stream = append(stream, welcomeFrame...)
+	stream = append(stream, garbage...)
+	stream = append(stream, batchStartFrame...)
+	stream = append(stream, dataChunk("first")...)
+	stream = append(stream, 0x00)
+	stream = append(stream, dataChunk("second")...)
+	stream = append(stream, 0xff)
+
+	frames, skipped := parseOneByteAtATime(t, stream)
+	checkFrames(t, frames, "welcome 0123456789abcdef01234567", "start 00010203", "data first", "data second", "end")
+	if want := 2*len(garbage) + len(unknown) + 1; skipped != want {
+		t.Errorf("skipped %d bytes, want %d", skipped, want)
+	}
+}
+
+func TestStreamParserIndefiniteLengths(t *testing.T) {
+	// {_ "part": "session", "dev": (_ "0123456789ab", "cdef01234567")}
+	welcome := mustHex("bf" + "6470617274" + "6773657373696f6e" + "63646576" +
+		"7f" + "6c303132333435363738396162" + "6c636465663031323334353637" + "ff" + "ff")
+	// {_ "part": "batch", "id": 7, "stream": (_ h'..', h'..'), the stream's break then the map's
+	batch := append(mustHex("bf"+"6470617274"+"656261746368"+"626964"+"07"+"6673747265616d"+"5f"),
+		dataChunk("first")...)
+	batch = append(batch, dataChunk("second")...)
+	batch = append(batch, 0xff, 0xff)
+
+	frames, skipped := parseOneByteAtATime(t, append(welcome, batch...))
+	// the map's break reads as a second batch end, which the session ignores outside a batch
+	checkFrames(t, frames, "welcome 0123456789abcdef01234567", "start 00000007", "data first", "data second", "end",
+		"end")
+	if skipped != 0 {
+		t.Errorf("skipped %d bytes", skipped)
+	}
+}
+
+func TestStreamParserReadsOverOtherItems(t *testing.T) {
+	welcome := map[interface{}]interface{}{
+		"proto":   "raw",
+		"part":    "session",
+		"dev":     "0123456789abcdef01234567",
+		"version": "2",
+		"offset":  -5,
+		"temp":    1.5,
+		"list":    []interface{}{1, "a", map[string]interface{}{"k": nil}},
+		"tagged":  cbor.Tag{Number: 1, Content: uint64(0)},
+		"ok":      true,
+		7:         "numeric key",
+	}
+	data, err := cbor.Marshal(welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames, skipped := parseOneByteAtATime(t, data)
+	checkFrames(t, frames, "welcome 0123456789abcdef01234567")
+	if skipped != 0 {
+		t.Errorf("skipped %d bytes", skipped)
+	}
+}
+
+func TestStreamParserWholeBatchInOneByteString(t *testing.T) {
+	// {"part": "batch", "id": 7, "stream": h'68656c6c6f'}
+	batch := mustHex("a3" + "6470617274" + "656261746368" + "626964" + "07" + "6673747265616d" + "4568656c6c6f")
+	frames, _ := parseOneByteAtATime(t, append(batch, welcomeFrame...))
+	checkFrames(t, frames, "start 00000007", "data hello", "end", "welcome 0123456789abcdef01234567")
+}
+
+func TestStreamParserRejectsOtherStreams(t *testing.T) {
+	// a batch start whose stream is text can't be followed, and mustn't leave a batch open that never ends
+	batch := mustHex("a4" + "6570726f746f" + "63726177" + "6470617274" + "656261746368" + "626964" +
+		"1a00010203" + "6673747265616d" + "6474657874")
+	frames, skipped := parseOneByteAtATime(t, append(batch, testBatch(1, 4)...))
+	checkFrames(t, frames, "start 00010203", "data \x00\x00\x00\x00", "end")
+	if skipped != len(batch) {
+		t.Errorf("skipped %d bytes, want the %d of the rejected batch start", skipped, len(batch))
+	}
+}
+
+func TestSessionWithoutWelcomeOrBatchStart(t *testing.T) {
+	server, address := newTestServer(t)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	pod := &testPod{t: t, conn: conn, decoder: cbor.NewDecoder(conn)}
+
+	// straight into a batch, without saying hello
+	pod.startBatch(1)
+	pod.sendData([]byte("no welcome"))
+	pod.endBatch(1)
+	if got := readBatch(t, server.filePath, unknownDeviceId, "00000001"); got != "no welcome" {
+		t.Errorf("batch is %q", got)
+	}
+
+	// data without a batch start is saved, but there's no id to ack it with, so the next ack is for batch 2
+	pod.sendData([]byte("no batch start"))
+	pod.send([]byte{0xff})
+	pod.startBatch(2)
+	pod.sendData([]byte("announced"))
+	pod.endBatch(2)
+
+	matches, err := filepath.Glob(filepath.Join(server.filePath, unknownDeviceId, "unannounced-*.RAW"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("got %v %v, want one unannounced batch", matches, err)
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("no batch start")) {
+		t.Errorf("unannounced batch is %q", data)
+	}
+}
@@ -0,0 +1,402 @@
+package MqttBridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"EightSleepServer/SparkServer"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+/*
+The bridge publishes every connected pod to an mqtt broker, announced to Home Assistant through discovery, and turns
+messages on the command topics into pod commands.
+
+State topics (retained):
+	<prefix>/<device id>/availability               online / offline
+	<prefix>/<device id>/<side>/level               heat level
+	<prefix>/<device id>/<side>/target_level        target heat level
+	<prefix>/<device id>/<side>/temperature         calibrated °F
+	<prefix>/<device id>/<side>/target_temperature  calibrated °F
+	<prefix>/<device id>/<side>/heat_time           seconds left
+	<prefix>/<device id>/<side>/mode                off / heat_cool
+	<prefix>/<device id>/<side>/alarm               ON / OFF
+	<prefix>/<device id>/water_low                  ON / OFF
+	<prefix>/<device id>/priming                    ON / OFF
+
+Command topics:
+	<prefix>/<device id>/<side>/level/set        SetLevel
+	<prefix>/<device id>/<side>/temperature/set  SetTemperature in °F
+	<prefix>/<device id>/<side>/time/set         SetTime in seconds
+	<prefix>/<device id>/<side>/mode/set         off turns the side off, heat_cool turns it on for the default heat time
+	<prefix>/<device id>/<side>/alarm/set        alarm params json to arm, OFF to clear, ON to re-arm the last armed
+	                                             alarm at the next occurrence of its time of day
+	<prefix>/<device id>/prime/set               prime
+*/
+
+const (
+	payloadOn    = "ON"
+	payloadOff   = "OFF"
+	modeOff      = "off"
+	modeHeatCool = "heat_cool"
+)
+
+type Config struct {
+	Broker          string
+	Username        string
+	Password        string
+	ClientId        string
+	TopicPrefix     string
+	DiscoveryPrefix string
+	HeatTime        int // seconds a side runs for when turned on from home assistant
+}
+
+// commandTarget is what the command topics drive, a *SparkServer.PodConnection.
+type commandTarget interface {
+	SetLevelFrom(source SparkServer.CommandSource, level int, side SparkServer.BedSide) error
+	SetTimeFrom(source SparkServer.CommandSource, seconds int, side SparkServer.BedSide) error
+	Calibration() *SparkServer.CalibrationStore
+	Allow(source SparkServer.CommandSource) error
+	SetAlarmParams(side SparkServer.BedSide, alarmParams SparkServer.AlarmParams) error
+	ClearAlarm(side SparkServer.BedSide) error
+	RearmAlarm(side SparkServer.BedSide) error
+	Prime(source SparkServer.CommandSource) error
+}
+
+type Bridge struct {
+	spark           *SparkServer.Server
+	findPod         func(deviceId string) (commandTarget, bool)
+	client          mqtt.Client
+	topicPrefix     string
+	discoveryPrefix string
+	heatTime        int
+	announced       map[string]bool   // device ids whose discovery configs have been published
+	commands        chan mqtt.Message // handled in order by runCommands, so paho's router isn't held up by the pod
+	mutex           sync.Mutex
+	logger          *zap.Logger
+}
+
+func NewBridge(spark *SparkServer.Server, config Config) *Bridge {
+	logger, _ := zap.NewProduction()
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = "eightsleep"
+	}
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = "homeassistant"
+	}
+	if config.ClientId == "" {
+		config.ClientId = "eightsleep-pod-server"
+	}
+	if config.HeatTime == 0 {
+		config.HeatTime = 8 * 60 * 60
+	}
+
+	b := &Bridge{
+		spark:           spark,
+		topicPrefix:     config.TopicPrefix,
+		discoveryPrefix: config.DiscoveryPrefix,
+		heatTime:        config.HeatTime,
+		announced:       make(map[string]bool),
+		commands:        make(chan mqtt.Message, 32),
+		logger:          logger,
+	}
+	go b.runCommands()
+	b.findPod = func(deviceId string) (commandTarget, bool) {
+		pod, ok := spark.GetPod(deviceId)
+		if !ok {
+			return nil, false
+		}
+		return pod, true
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientId).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetWill(b.bridgeAvailabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			b.logger.Warn("Lost connection to mqtt broker", zap.Error(err))
+		})
+	b.client = mqtt.NewClient(opts)
+	return b
+}
+
+func (b *Bridge) topic(parts ...string) string {
+	return b.topicPrefix + "/" + strings.Join(parts, "/")
+}
+
+func (b *Bridge) bridgeAvailabilityTopic() string {
+	return b.topic("bridge", "availability")
+}
+
+// StartBridge connects to the broker and keeps the pods' state published until the process exits.
+func (b *Bridge) StartBridge() {
+	b.logger.Info("Starting MqttBridge")
+	events, unsubscribe := b.spark.Events().Subscribe()
+	defer unsubscribe()
+
+	token := b.client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		b.logger.Error("Error connecting to mqtt broker", zap.Error(token.Error()))
+	}
+
+	for event := range events {
+		switch event.Type {
+		case SparkServer.EventConnected:
+			b.announce(event.DeviceId)
+		case SparkServer.EventDisconnected:
+			b.publish(b.topic(event.DeviceId, "availability"), "offline")
+		case SparkServer.EventStatusChanged:
+			pod, ok := b.spark.GetPod(event.DeviceId)
+			if ok {
+				b.publishState(pod)
+			}
+		case SparkServer.EventCommand:
+			// the status read after the command follows as a status change, until then publish what was set
+			pod, ok := b.spark.GetPod(event.DeviceId)
+			command, isCommand := event.Data.(SparkServer.CommandEvent)
+			if ok && isCommand {
+				b.publishCommand(event.DeviceId, pod.Calibration().Get(), command)
+			}
+		}
+	}
+}
+
+func (b *Bridge) onConnect(client mqtt.Client) {
+	b.logger.Info("Connected to mqtt broker")
+	b.publish(b.bridgeAvailabilityTopic(), "online")
+	// only the command topics, not the state we publish ourselves
+	token := client.SubscribeMultiple(map[string]byte{
+		b.topic("+", "+", "+", "set"): 1,
+		b.topic("+", "prime", "set"):  1,
+	}, b.handleCommand)
+	token.Wait()
+	if token.Error() != nil {
+		b.logger.Error("Error subscribing to command topics", zap.Error(token.Error()))
+	}
+	// (re)announce everything already connected, the broker may have lost our retained messages
+	b.mutex.Lock()
+	b.announced = make(map[string]bool)
+	b.mutex.Unlock()
+	for _, pod := range b.spark.Pods() {
+		b.announce(pod.DeviceId())
+	}
+}
+
+func (b *Bridge) publish(topic string, payload interface{}) {
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+	token := b.client.Publish(topic, 1, true, payload)
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			b.logger.Error("Error publishing to mqtt", zap.String("topic", topic), zap.Error(token.Error()))
+		}
+	}()
+}
+
+func (b *Bridge) announce(deviceId string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.client.IsConnectionOpen() || b.announced[deviceId] {
+		return
+	}
+	messages, err := b.discoveryMessages(deviceId)
+	if err != nil {
+		b.logger.Error("Error building discovery messages", zap.Error(err))
+		return
+	}
+	for _, message := range messages {
+		b.publish(message.topic, message.payload)
+	}
+	b.publish(b.topic(deviceId, "availability"), "online")
+	b.announced[deviceId] = true
+
+	pod, ok := b.spark.GetPod(deviceId)
+	if ok {
+		b.publishState(pod)
+	}
+}
+
+func onOff(v bool) string {
+	if v {
+		return payloadOn
+	}
+	return payloadOff
+}
+
+func (b *Bridge) publishState(pod *SparkServer.PodConnection) {
+	status := pod.LastStatus()
+	if status == nil {
+		return
+	}
+	deviceId := pod.DeviceId()
+	b.publish(b.topic(deviceId, "water_low"), onOff(!status.WaterLevel))
+	b.publish(b.topic(deviceId, "priming"), onOff(status.Priming))
+
+	sides := map[SparkServer.BedSide]SparkServer.BedStatus{
+		SparkServer.BedSideLeft:  status.LeftBed,
+		SparkServer.BedSideRight: status.RightBed,
+	}
+	for side, bed := range sides {
+		sideName := side.String()
+		mode := modeOff
+		if bed.HeatTime > 0 {
+			mode = modeHeatCool
+		}
+		b.publish(b.topic(deviceId, sideName, "level"), strconv.Itoa(bed.HeatLevel))
+		b.publish(b.topic(deviceId, sideName, "target_level"), strconv.Itoa(bed.TargetHeatLevel))
+		b.publish(b.topic(deviceId, sideName, "temperature"), fmt.Sprintf("%.1f", bed.HeatTemperature.Fahrenheit))
+		b.publish(b.topic(deviceId, sideName, "target_temperature"), fmt.Sprintf("%.1f", bed.TargetTemperature.Fahrenheit))
+		b.publish(b.topic(deviceId, sideName, "heat_time"), strconv.Itoa(bed.HeatTime))
+		b.publish(b.topic(deviceId, sideName, "mode"), mode)
+		b.publish(b.topic(deviceId, sideName, "alarm"), onOff(pod.GetStoredAlarm(side).Armed()))
+	}
+}
+
+// publishCommand publishes the state a command set, a level or heat time written to a side.
+func (b *Bridge) publishCommand(deviceId string, calibration SparkServer.Calibration, command SparkServer.CommandEvent) {
+	side := SparkServer.BedSideLeft
+	field, isLeft := strings.CutPrefix(command.Path, "left")
+	if !isLeft {
+		var isRight bool
+		field, isRight = strings.CutPrefix(command.Path, "right")
+		if !isRight {
+			return
+		}
+		side = SparkServer.BedSideRight
+	}
+	value, err := strconv.Atoi(command.Value)
+	if err != nil {
+		return
+	}
+
+	sideName := side.String()
+	switch field {
+	case "Level":
+		b.publish(b.topic(deviceId, sideName, "target_level"), strconv.Itoa(value))
+		b.publish(b.topic(deviceId, sideName, "target_temperature"), fmt.Sprintf("%.1f", calibration.Temperature(value, side).Fahrenheit))
+	case "Heat":
+		mode := modeOff
+		if value > 0 {
+			mode = modeHeatCool
+		}
+		b.publish(b.topic(deviceId, sideName, "heat_time"), strconv.Itoa(value))
+		b.publish(b.topic(deviceId, sideName, "mode"), mode)
+	}
+}
+
+// handleCommand queues a message on one of our /set topics for runCommands.  It runs on paho's router, which must
+// not wait on the pod, so if the queue is full the command is dropped.
+func (b *Bridge) handleCommand(_ mqtt.Client, msg mqtt.Message) {
+	select {
+	case b.commands <- msg:
+	default:
+		b.logger.Warn("Too many mqtt commands queued, dropping", zap.String("topic", msg.Topic()))
+	}
+}
+
+func (b *Bridge) runCommands() {
+	for msg := range b.commands {
+		b.runCommand(msg)
+	}
+}
+
+// runCommand turns a message on one of our /set topics into a pod command.
+func (b *Bridge) runCommand(msg mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), b.topicPrefix+"/"), "/")
+	if len(parts) < 3 || parts[len(parts)-1] != "set" {
+		return
+	}
+	pod, ok := b.findPod(parts[0])
+	if !ok {
+		b.logger.Warn("Mqtt command for unknown pod", zap.String("topic", msg.Topic()))
+		return
+	}
+	payload := strings.TrimSpace(string(msg.Payload()))
+
+	var err error
+	if len(parts) == 3 && parts[1] == "prime" {
+		err = pod.Prime(SparkServer.SourceMqtt)
+	} else if len(parts) == 4 {
+		err = b.handleSideCommand(pod, parts[1], parts[2], payload)
+	} else {
+		return
+	}
+	if err != nil {
+		b.logger.Error("Error handling mqtt command", zap.String("topic", msg.Topic()), zap.String("payload", payload), zap.Error(err))
+		return
+	}
+	b.logger.Info("Handled mqtt command", zap.String("topic", msg.Topic()), zap.String("payload", payload))
+}
+
+func (b *Bridge) handleSideCommand(pod commandTarget, sideName string, command string, payload string) error {
+	side, err := SparkServer.ParseBedSide(sideName)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "level":
+		level, err := strconv.Atoi(payload)
+		if err != nil {
+			return err
+		}
+		return pod.SetLevelFrom(SparkServer.SourceMqtt, level, side)
+	case "temperature":
+		temperature, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return err
+		}
+		level, err := pod.Calibration().Get().Level(temperature, SparkServer.Fahrenheit, side)
+		if err != nil {
+			return err
+		}
+		return pod.SetLevelFrom(SparkServer.SourceMqtt, level, side)
+	case "time":
+		seconds, err := strconv.Atoi(payload)
+		if err != nil {
+			return err
+		}
+		return pod.SetTimeFrom(SparkServer.SourceMqtt, seconds, side)
+	case "mode":
+		switch payload {
+		case modeOff:
+			return pod.SetTimeFrom(SparkServer.SourceMqtt, 0, side)
+		case modeHeatCool:
+			return pod.SetTimeFrom(SparkServer.SourceMqtt, b.heatTime, side)
+		}
+		return fmt.Errorf("unknown mode %q", payload)
+	case "alarm":
+		err := pod.Allow(SparkServer.SourceMqtt)
+		if err != nil {
+			return err
+		}
+		switch payload {
+		case payloadOff:
+			return pod.ClearAlarm(side)
+		case payloadOn:
+			return pod.RearmAlarm(side)
+		}
+		var alarm SparkServer.AlarmParams
+		err = json.Unmarshal([]byte(payload), &alarm)
+		if err != nil {
+			return fmt.Errorf("alarm payload must be ON, OFF or alarm params json: %w", err)
+		}
+		return pod.SetAlarmParams(side, alarm)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
@@ -0,0 +1,276 @@
+package MqttBridge
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"EightSleepServer/SparkServer"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// fakePod records the commands the bridge sends it, each waiting on release first if it is set.
+type fakePod struct {
+	calls   chan string
+	release chan struct{}
+}
+
+func (p *fakePod) record(format string, args ...interface{}) error {
+	if p.release != nil {
+		<-p.release
+	}
+	p.calls <- fmt.Sprintf(format, args...)
+	return nil
+}
+
+func (p *fakePod) SetLevelFrom(source SparkServer.CommandSource, level int, side SparkServer.BedSide) error {
+	return p.record("%s level %s %d", source, side, level)
+}
+
+func (p *fakePod) SetTimeFrom(source SparkServer.CommandSource, seconds int, side SparkServer.BedSide) error {
+	return p.record("%s time %s %d", source, side, seconds)
+}
+
+func (p *fakePod) Calibration() *SparkServer.CalibrationStore {
+	return nil
+}
+
+func (p *fakePod) Allow(SparkServer.CommandSource) error {
+	return nil
+}
+
+func (p *fakePod) SetAlarmParams(side SparkServer.BedSide, alarmParams SparkServer.AlarmParams) error {
+	return p.record("arm %s %d", side, alarmParams.Time)
+}
+
+func (p *fakePod) ClearAlarm(side SparkServer.BedSide) error {
+	return p.record("clear %s", side)
+}
+
+func (p *fakePod) RearmAlarm(side SparkServer.BedSide) error {
+	return p.record("rearm %s", side)
+}
+
+func (p *fakePod) Prime(source SparkServer.CommandSource) error {
+	return p.record("%s prime", source)
+}
+
+// fakeMessage is a message as paho hands it to a handler.
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+func startBroker(t *testing.T) *mochi.Server {
+	t.Helper()
+	broker := mochi.New(&mochi.Options{InlineClient: true})
+	err := broker.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+	return broker
+}
+
+func newSparkServer(t *testing.T) *SparkServer.Server {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "server.key")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SparkServer.NewServer(path, 0, "")
+}
+
+func TestBridgeCommands(t *testing.T) {
+	broker := startBroker(t)
+	listener, _ := broker.Listeners.Get("test")
+
+	pod := &fakePod{calls: make(chan string, 10)}
+	bridge := NewBridge(newSparkServer(t), Config{Broker: "tcp://" + listener.Address()})
+	bridge.findPod = func(deviceId string) (commandTarget, bool) {
+		return pod, deviceId == "pod"
+	}
+	token := bridge.client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer bridge.client.Disconnect(0)
+
+	var filters map[string]bool
+	for deadline := time.Now().Add(5 * time.Second); len(filters) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bridge subscribed to %v", filters)
+		}
+		client, ok := broker.Clients.Get("eightsleep-pod-server")
+		if !ok {
+			continue
+		}
+		filters = make(map[string]bool)
+		for filter := range client.State.Subscriptions.GetAll() {
+			filters[filter] = true
+		}
+	}
+	if len(filters) != 2 || !filters["eightsleep/+/+/+/set"] || !filters["eightsleep/+/prime/set"] {
+		t.Errorf("bridge subscribed to %v, want only the command topics", filters)
+	}
+
+	tests := []struct {
+		topic   string
+		payload string
+		want    string
+	}{
+		{"eightsleep/pod/left/level/set", "30", "mqtt level left 30"},
+		{"eightsleep/pod/right/time/set", "3600", "mqtt time right 3600"},
+		{"eightsleep/pod/right/mode/set", "off", "mqtt time right 0"},
+		{"eightsleep/pod/left/alarm/set", "OFF", "clear left"},
+		{"eightsleep/pod/left/alarm/set", "ON", "rearm left"},
+		{"eightsleep/pod/right/alarm/set", `{"intensity": 50, "duration": 60, "time": 1700000000, "pattern": "double"}`, "arm right 1700000000"},
+		{"eightsleep/pod/prime/set", "PRESS", "mqtt prime"},
+	}
+	for _, test := range tests {
+		// a state topic and a pod we don't know about first, neither should reach the pod
+		err := broker.Publish("eightsleep/pod/left/level", []byte("99"), false, 1)
+		if err == nil {
+			err = broker.Publish("eightsleep/other/left/level/set", []byte("99"), false, 1)
+		}
+		if err == nil {
+			err = broker.Publish(test.topic, []byte(test.payload), false, 1)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case call := <-pod.calls:
+			if call != test.want {
+				t.Errorf("%s %s: pod got %q, want %q", test.topic, test.payload, call, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s: pod got nothing", test.topic, test.payload)
+		}
+	}
+}
+
+func TestHandleCommandDoesNotWaitForThePod(t *testing.T) {
+	pod := &fakePod{calls: make(chan string, 10), release: make(chan struct{})}
+	bridge := NewBridge(newSparkServer(t), Config{Broker: "tcp://127.0.0.1:1"})
+	bridge.findPod = func(deviceId string) (commandTarget, bool) {
+		return pod, true
+	}
+
+	// the pod is stuck on the first command, paho's router must still get its goroutine back
+	handled := make(chan struct{})
+	go func() {
+		bridge.handleCommand(nil, fakeMessage{topic: "eightsleep/pod/left/level/set", payload: "10"})
+		bridge.handleCommand(nil, fakeMessage{topic: "eightsleep/pod/left/level/set", payload: "20"})
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handleCommand waited for the pod")
+	}
+
+	close(pod.release)
+	for _, want := range []string{"mqtt level left 10", "mqtt level left 20"} {
+		select {
+		case call := <-pod.calls:
+			if call != want {
+				t.Errorf("pod got %q, want %q", call, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("pod never got %q", want)
+		}
+	}
+}
+
+func TestPublishCommand(t *testing.T) {
+	broker := startBroker(t)
+	listener, _ := broker.Listeners.Get("test")
+	published := make(chan [2]string, 10)
+	err := broker.Subscribe("eightsleep/pod/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		published <- [2]string{pk.TopicName, string(pk.Payload)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bridge := NewBridge(newSparkServer(t), Config{Broker: "tcp://" + listener.Address()})
+	token := bridge.client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer bridge.client.Disconnect(0)
+
+	calibration := SparkServer.Calibration{LeftOffset: 1}
+	tests := []struct {
+		command SparkServer.CommandEvent
+		want    map[string]string
+	}{
+		{SparkServer.CommandEvent{Path: "leftLevel", Value: "0"}, map[string]string{
+			"eightsleep/pod/left/target_level":       "0",
+			"eightsleep/pod/left/target_temperature": "83.5",
+		}},
+		{SparkServer.CommandEvent{Path: "rightHeat", Value: "3600"}, map[string]string{
+			"eightsleep/pod/right/heat_time": "3600",
+			"eightsleep/pod/right/mode":      "heat_cool",
+		}},
+		{SparkServer.CommandEvent{Path: "rightHeat", Value: "0"}, map[string]string{
+			"eightsleep/pod/right/heat_time": "0",
+			"eightsleep/pod/right/mode":      "off",
+		}},
+	}
+	for _, test := range tests {
+		bridge.publishCommand("pod", calibration, test.command)
+		got := make(map[string]string)
+		for len(got) < len(test.want) {
+			select {
+			case message := <-published:
+				got[message[0]] = message[1]
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s %s: got %v, want %v", test.command.Path, test.command.Value, got, test.want)
+			}
+		}
+		for topic, payload := range test.want {
+			if got[topic] != payload {
+				t.Errorf("%s %s: got %s = %q, want %q", test.command.Path, test.command.Value, topic, got[topic], payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package MqttBridge
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"EightSleepServer/SparkServer"
+)
+
+/*
+Home Assistant discovery: each entity gets a retained config message under
+<discovery prefix>/<component>/eightsleep_<device id>/<object>/config, pointing at our state and command topics.
+*/
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haEntity struct {
+	Name         string           `json:"name"`
+	UniqueId     string           `json:"unique_id"`
+	Device       haDevice         `json:"device"`
+	Availability []haAvailability `json:"availability"`
+
+	StateTopic   string `json:"state_topic,omitempty"`
+	CommandTopic string `json:"command_topic,omitempty"`
+	DeviceClass  string `json:"device_class,omitempty"`
+	PayloadOn    string `json:"payload_on,omitempty"`
+	PayloadOff   string `json:"payload_off,omitempty"`
+	Icon         string `json:"icon,omitempty"`
+
+	// climate
+	Modes                   []string `json:"modes,omitempty"`
+	ModeStateTopic          string   `json:"mode_state_topic,omitempty"`
+	ModeCommandTopic        string   `json:"mode_command_topic,omitempty"`
+	TemperatureStateTopic   string   `json:"temperature_state_topic,omitempty"`
+	TemperatureCommandTopic string   `json:"temperature_command_topic,omitempty"`
+	CurrentTemperatureTopic string   `json:"current_temperature_topic,omitempty"`
+	TemperatureUnit         string   `json:"temperature_unit,omitempty"`
+	MinTemp                 float64  `json:"min_temp,omitempty"`
+	MaxTemp                 float64  `json:"max_temp,omitempty"`
+	TempStep                float64  `json:"temp_step,omitempty"`
+}
+
+type discoveryMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (b *Bridge) discoveryMessages(deviceId string) ([]discoveryMessage, error) {
+	shortId := deviceId
+	if len(shortId) > 4 {
+		shortId = shortId[len(shortId)-4:]
+	}
+	device := haDevice{
+		Identifiers:  []string{"eightsleep_" + deviceId},
+		Name:         "Eight Sleep Pod " + shortId,
+		Manufacturer: "Eight Sleep",
+		Model:        "Pod 2",
+	}
+	availability := []haAvailability{{Topic: b.bridgeAvailabilityTopic()}, {Topic: b.topic(deviceId, "availability")}}
+	entity := func(object string, name string) haEntity {
+		return haEntity{
+			Name:         name,
+			UniqueId:     fmt.Sprintf("eightsleep_%s_%s", deviceId, object),
+			Device:       device,
+			Availability: availability,
+		}
+	}
+
+	var entities []struct {
+		component string
+		object    string
+		entity    haEntity
+	}
+	add := func(component string, object string, e haEntity) {
+		entities = append(entities, struct {
+			component string
+			object    string
+			entity    haEntity
+		}{component, object, e})
+	}
+
+	for _, side := range []SparkServer.BedSide{SparkServer.BedSideLeft, SparkServer.BedSideRight} {
+		sideName := side.String()
+		climate := entity(sideName, fmt.Sprintf("%s side", sideName))
+		climate.Modes = []string{modeOff, modeHeatCool}
+		climate.ModeStateTopic = b.topic(deviceId, sideName, "mode")
+		climate.ModeCommandTopic = b.topic(deviceId, sideName, "mode", "set")
+		climate.TemperatureStateTopic = b.topic(deviceId, sideName, "target_temperature")
+		climate.TemperatureCommandTopic = b.topic(deviceId, sideName, "temperature", "set")
+		climate.CurrentTemperatureTopic = b.topic(deviceId, sideName, "temperature")
+		climate.TemperatureUnit = "F"
+		climate.MinTemp = SparkServer.LevelToFahrenheit(SparkServer.MinHeatLevel)
+		climate.MaxTemp = SparkServer.LevelToFahrenheit(SparkServer.MaxHeatLevel)
+		climate.TempStep = 0.5
+		add("climate", sideName, climate)
+
+		alarm := entity(sideName+"_alarm", fmt.Sprintf("%s alarm", sideName))
+		alarm.StateTopic = b.topic(deviceId, sideName, "alarm")
+		alarm.CommandTopic = b.topic(deviceId, sideName, "alarm", "set")
+		alarm.PayloadOn = payloadOn
+		alarm.PayloadOff = payloadOff
+		alarm.Icon = "mdi:alarm"
+		add("switch", sideName+"_alarm", alarm)
+	}
+
+	water := entity("water_low", "Water tank low")
+	water.StateTopic = b.topic(deviceId, "water_low")
+	water.DeviceClass = "problem"
+	water.PayloadOn = payloadOn
+	water.PayloadOff = payloadOff
+	add("binary_sensor", "water_low", water)
+
+	priming := entity("priming", "Priming")
+	priming.StateTopic = b.topic(deviceId, "priming")
+	priming.DeviceClass = "running"
+	priming.PayloadOn = payloadOn
+	priming.PayloadOff = payloadOff
+	add("binary_sensor", "priming", priming)
+
+	prime := entity("prime", "Prime")
+	prime.CommandTopic = b.topic(deviceId, "prime", "set")
+	prime.Icon = "mdi:water-pump"
+	add("button", "prime", prime)
+
+	messages := make([]discoveryMessage, 0, len(entities))
+	for _, e := range entities {
+		payload, err := json.Marshal(e.entity)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, discoveryMessage{
+			topic:   fmt.Sprintf("%s/%s/eightsleep_%s/%s/config", b.discoveryPrefix, e.component, deviceId, e.object),
+			payload: payload,
+		})
+	}
+	return messages, nil
+}
@@ -0,0 +1,308 @@
+package SparkServer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+The pod 2 only holds a single absolute alarm time per side, so anything recurring has to be re-armed by us.
+The scheduler keeps weekly alarms per side, and arms the next occurrence whenever the pod connects and after each
+alarm has gone off.  Times are wall clock times in the alarm's timezone, so a 07:00 alarm stays at 07:00 across
+DST changes.  On a spring forward day an alarm inside the skipped hour fires an hour later.
+*/
+
+var ErrAlarmNotFound = errors.New("recurring alarm not found")
+
+type RecurringAlarm struct {
+	Id        string         `json:"id"`
+	Side      BedSide        `json:"side"`
+	Days      []time.Weekday `json:"days"` // 0 = sunday
+	Time      string         `json:"time"` // HH:MM
+	Timezone  string         `json:"timezone"`
+	Pattern   string         `json:"pattern"`
+	Intensity int            `json:"intensity"`
+	Duration  int            `json:"duration"`
+	Enabled   bool           `json:"enabled"`
+}
+
+func (a RecurringAlarm) Validate() error {
+	if a.Side != BedSideLeft && a.Side != BedSideRight {
+		return Invalidf("invalid side %d", a.Side)
+	}
+	err := validateWeekdays(a.Days)
+	if err != nil {
+		return err
+	}
+	_, err = parseTimeOfDay(a.Time)
+	if err != nil {
+		return err
+	}
+	_, err = a.location()
+	if err != nil {
+		return Invalidf("invalid timezone %q: %w", a.Timezone, err)
+	}
+	return a.params(time.Time{}).Validate(time.Time{})
+}
+
+// NextOccurrence returns the first time the alarm goes off strictly after after.
+func (a RecurringAlarm) NextOccurrence(after time.Time) (time.Time, error) {
+	loc, err := a.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	timeOfDay, err := parseTimeOfDay(a.Time)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	local := after.In(loc)
+	// 8 days covers an alarm set for today's weekday at a time that has already passed
+	for i := 0; i <= 7; i++ {
+		candidate := wallClock(local.Year(), local.Month(), local.Day()+i, timeOfDay, loc)
+		if !a.onDay(candidate.Weekday()) || !candidate.After(after) {
+			continue
+		}
+		return candidate, nil
+	}
+	return time.Time{}, Invalidf("recurring alarm has no days")
+}
+
+func (a RecurringAlarm) location() (*time.Location, error) {
+	return loadLocation(a.Timezone)
+}
+
+func (a RecurringAlarm) onDay(day time.Weekday) bool {
+	return containsWeekday(a.Days, day)
+}
+
+// loadLocation returns the named timezone, the server's local time if none was given.
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timezone)
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWeekdays(days []time.Weekday) error {
+	if len(days) == 0 {
+		return Invalidf("at least one day is required")
+	}
+	for _, day := range days {
+		if day < time.Sunday || day > time.Saturday {
+			return Invalidf("invalid day %d", day)
+		}
+	}
+	return nil
+}
+
+// wallClock returns hh:mm on the given date, moving past the gap if that time doesn't exist on a spring forward day.
+func wallClock(year int, month time.Month, day int, timeOfDay time.Duration, loc *time.Location) time.Time {
+	hour := int(timeOfDay / time.Hour)
+	minute := int((timeOfDay % time.Hour) / time.Minute)
+	t := time.Date(year, month, day, hour, minute, 0, 0, loc)
+	if t.Hour() != hour || t.Minute() != minute {
+		// go doesn't promise which side of the gap it picks, so move to the wall clock time after the gap
+		_, offsetBefore := t.Zone()
+		_, offsetAfter := t.Add(3 * time.Hour).Zone()
+		t = t.Add(time.Duration(offsetAfter-offsetBefore) * time.Second)
+	}
+	return t
+}
+
+func newId() (string, error) {
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+func (a RecurringAlarm) params(at time.Time) AlarmParams {
+	var tt uint64
+	if !at.IsZero() {
+		tt = uint64(at.Unix())
+	}
+	return AlarmParams{
+		Intensity: a.Intensity,
+		Duration:  a.Duration,
+		Time:      tt,
+		Pattern:   a.Pattern,
+	}
+}
+
+// AlarmScheduler owns the recurring alarms of one pod.
+type AlarmScheduler struct {
+	path    string
+	alarms  []RecurringAlarm
+	mutex   sync.Mutex
+	changed chan struct{}
+	logger  *zap.Logger
+}
+
+func NewAlarmScheduler(path string, logger *zap.Logger) (*AlarmScheduler, error) {
+	s := &AlarmScheduler{
+		path:    path,
+		changed: make(chan struct{}, 1),
+		logger:  logger,
+	}
+	if path != "" {
+		err := readJSONFile(path, &s.alarms)
+		if err != nil {
+			return nil, fmt.Errorf("loading recurring alarms: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *AlarmScheduler) List() []RecurringAlarm {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]RecurringAlarm(nil), s.alarms...)
+}
+
+// Add stores a new recurring alarm, assigning it an id.
+func (s *AlarmScheduler) Add(alarm RecurringAlarm) (RecurringAlarm, error) {
+	err := alarm.Validate()
+	if err != nil {
+		return alarm, err
+	}
+	alarm.Id, err = newId()
+	if err != nil {
+		return alarm, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	alarms := append(append([]RecurringAlarm(nil), s.alarms...), alarm)
+	return alarm, s.replaceLocked(alarms)
+}
+
+func (s *AlarmScheduler) Update(alarm RecurringAlarm) error {
+	err := alarm.Validate()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.alarms {
+		if s.alarms[i].Id == alarm.Id {
+			alarms := append([]RecurringAlarm(nil), s.alarms...)
+			alarms[i] = alarm
+			return s.replaceLocked(alarms)
+		}
+	}
+	return ErrAlarmNotFound
+}
+
+func (s *AlarmScheduler) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.alarms {
+		if s.alarms[i].Id == id {
+			alarms := append(append([]RecurringAlarm(nil), s.alarms[:i]...), s.alarms[i+1:]...)
+			return s.replaceLocked(alarms)
+		}
+	}
+	return ErrAlarmNotFound
+}
+
+// replaceLocked saves alarms and only then swaps them in, so a failed write leaves memory matching the file.
+func (s *AlarmScheduler) replaceLocked(alarms []RecurringAlarm) error {
+	if s.path != "" {
+		err := writeJSONFile(s.path, alarms)
+		if err != nil {
+			return err
+		}
+	}
+	s.alarms = alarms
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Next returns the next alarm to arm for a side.  An alarm that is still ringing counts as next,
+// so it isn't replaced before it finishes.
+func (s *AlarmScheduler) Next(side BedSide, now time.Time) (AlarmParams, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var next AlarmParams
+	var nextTime time.Time
+	for _, alarm := range s.alarms {
+		if !alarm.Enabled || alarm.Side != side {
+			continue
+		}
+		occurrence, err := alarm.NextOccurrence(now.Add(-time.Duration(alarm.Duration) * time.Second))
+		if err != nil {
+			s.logger.Error("Error computing next alarm", zap.String("id", alarm.Id), zap.Error(err))
+			continue
+		}
+		if nextTime.IsZero() || occurrence.Before(nextTime) {
+			nextTime = occurrence
+			next = alarm.params(occurrence)
+		}
+	}
+	return next, !nextTime.IsZero()
+}
+
+// Run keeps the pod armed with the next occurrence of each side's alarms until the pod disconnects.
+func (s *AlarmScheduler) Run(c *PodConnection) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	// what we last armed per side, so we only write to the pod when something changes
+	armed := map[BedSide]AlarmParams{}
+	for {
+		now := time.Now()
+		for _, side := range []BedSide{BedSideLeft, BedSideRight} {
+			next, ok := s.Next(side, now)
+			previous, wasArmed := armed[side]
+			switch {
+			case ok && !wasArmed && int64(next.Time) <= now.Unix():
+				// already ringing when we connected, it'll be replaced by the next occurrence once it's over
+			case ok && (!wasArmed || previous != next):
+				err := c.SetAlarmParams(side, next)
+				if err != nil {
+					s.logger.Error("Error arming recurring alarm", zap.Int("side", int(side)), zap.Error(err))
+					continue
+				}
+				s.logger.Info("Armed recurring alarm", zap.Int("side", int(side)), zap.Time("time", time.Unix(int64(next.Time), 0)))
+				armed[side] = next
+			case !ok && wasArmed:
+				// the alarm we armed was removed or disabled
+				err := c.ClearAlarm(side)
+				if err != nil {
+					s.logger.Error("Error clearing recurring alarm", zap.Int("side", int(side)), zap.Error(err))
+					continue
+				}
+				delete(armed, side)
+			}
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-s.changed:
+		case <-ticker.C:
+		}
+	}
+}
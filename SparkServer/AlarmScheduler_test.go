@@ -0,0 +1,141 @@
+package SparkServer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRecurringAlarmNextOccurrence(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	at := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, location)
+	}
+	tests := []struct {
+		name  string
+		days  []time.Weekday
+		time  string
+		after time.Time
+		want  time.Time
+	}{
+		{"later the same day", []time.Weekday{time.Tuesday}, "07:00", at(time.March, 12, 6, 0), at(time.March, 12, 7, 0)},
+		{"exactly now moves a week on", []time.Weekday{time.Tuesday}, "07:00", at(time.March, 12, 7, 0), at(time.March, 19, 7, 0)},
+		{"weekday rolls over the week end", []time.Weekday{time.Monday}, "07:00", at(time.March, 9, 23, 30), at(time.March, 11, 7, 0)},
+		{"saturday night to sunday", []time.Weekday{time.Sunday}, "00:15", at(time.March, 2, 23, 30), at(time.March, 3, 0, 15)},
+		{"first of several days", []time.Weekday{time.Friday, time.Wednesday}, "07:00", at(time.March, 12, 8, 0), at(time.March, 13, 7, 0)},
+		{"wall clock kept across spring forward", []time.Weekday{time.Monday}, "07:00", at(time.March, 9, 12, 0), at(time.March, 11, 7, 0)},
+		{"skipped by spring forward fires after the gap", []time.Weekday{time.Sunday}, "02:30", at(time.March, 9, 12, 0), at(time.March, 10, 3, 30)},
+		{"wall clock kept across fall back", []time.Weekday{time.Monday}, "07:00", at(time.November, 2, 12, 0), at(time.November, 4, 7, 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alarm := RecurringAlarm{Side: BedSideLeft, Days: test.days, Time: test.time, Timezone: "America/New_York"}
+			got, err := alarm.NextOccurrence(test.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("got %s, want %s", got.In(location), test.want)
+			}
+		})
+	}
+}
+
+func TestRecurringAlarmFiresOnceWhenFallBackRepeatsItsTime(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	alarm := RecurringAlarm{Side: BedSideLeft, Days: []time.Weekday{time.Sunday}, Time: "01:30", Timezone: "America/New_York"}
+
+	first, err := alarm.NextOccurrence(time.Date(2024, time.November, 2, 12, 0, 0, 0, location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := first.In(location)
+	if local.Day() != 3 || local.Hour() != 1 || local.Minute() != 30 {
+		t.Fatalf("got %s, want 01:30 on the 3rd", local)
+	}
+
+	// 01:30 happens twice that night, the second one mustn't ring again
+	weekLater := time.Date(2024, time.November, 10, 1, 30, 0, 0, location)
+	for _, after := range []time.Time{first, first.Add(time.Hour)} {
+		next, err := alarm.NextOccurrence(after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !next.Equal(weekLater) {
+			t.Errorf("after %s got %s, want %s", after.In(location), next.In(location), weekLater)
+		}
+	}
+}
+
+func TestWallClockSpringForward(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	tests := []struct {
+		name      string
+		timeOfDay time.Duration
+		want      time.Time
+	}{
+		{"before the gap", time.Hour + 59*time.Minute, time.Date(2024, time.March, 10, 1, 59, 0, 0, location)},
+		{"start of the gap", 2 * time.Hour, time.Date(2024, time.March, 10, 3, 0, 0, 0, location)},
+		{"inside the gap", 2*time.Hour + 30*time.Minute, time.Date(2024, time.March, 10, 3, 30, 0, 0, location)},
+		{"after the gap", 3 * time.Hour, time.Date(2024, time.March, 10, 3, 0, 0, 0, location)},
+	}
+	for _, test := range tests {
+		got := wallClock(2024, time.March, 10, test.timeOfDay, location)
+		if !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAlarmSchedulerKeepsMemoryWhenSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alarms.json")
+	s, err := NewAlarmScheduler(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarm, err := s.Add(RecurringAlarm{Side: BedSideLeft, Days: []time.Weekday{time.Monday}, Time: "07:00", Pattern: AlarmPatternDouble, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file where the directory should be makes every save fail
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dir, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Add(RecurringAlarm{Side: BedSideRight, Days: []time.Weekday{time.Monday}, Time: "08:00", Pattern: AlarmPatternDouble})
+	if err == nil {
+		t.Fatal("Add succeeded without saving")
+	}
+	changed := alarm
+	changed.Time = "09:00"
+	if err := s.Update(changed); err == nil {
+		t.Fatal("Update succeeded without saving")
+	}
+	if err := s.Remove(alarm.Id); err == nil {
+		t.Fatal("Remove succeeded without saving")
+	}
+
+	alarms := s.List()
+	if len(alarms) != 1 || alarms[0].Id != alarm.Id || alarms[0].Time != alarm.Time {
+		t.Fatalf("got %+v, want only %+v", alarms, alarm)
+	}
+}
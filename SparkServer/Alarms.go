@@ -0,0 +1,196 @@
+package SparkServer
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	MaxAlarmIntensity = 100
+	MaxAlarmDuration  = 600 // seconds
+
+	AlarmPatternDouble = "double"
+	AlarmPatternSingle = "single"
+)
+
+// AlarmParams is the cbor payload written to alarmL/alarmR.  The pod 2 only holds a single absolute time per side.
+type AlarmParams struct {
+	Intensity int    `cbor:"pl" json:"intensity"`
+	Duration  int    `cbor:"du" json:"duration"`
+	Time      uint64 `cbor:"tt" json:"time"`
+	Pattern   string `cbor:"pi" json:"pattern"`
+}
+
+// clearedAlarm is what the pod gets when a side has no alarm.
+var clearedAlarm = AlarmParams{
+	Intensity: 0,
+	Duration:  600,
+	Time:      0,
+	Pattern:   AlarmPatternDouble,
+}
+
+// Armed reports whether the params describe an alarm that will go off.
+func (a AlarmParams) Armed() bool {
+	return a.Intensity > 0 && a.Time > 0
+}
+
+func (a AlarmParams) Validate(now time.Time) error {
+	if a.Intensity < 0 || a.Intensity > MaxAlarmIntensity {
+		return Invalidf("alarm intensity %d out of range 0-%d", a.Intensity, MaxAlarmIntensity)
+	}
+	if a.Duration < 0 || a.Duration > MaxAlarmDuration {
+		return Invalidf("alarm duration %d out of range 0-%d", a.Duration, MaxAlarmDuration)
+	}
+	if a.Pattern != AlarmPatternDouble && a.Pattern != AlarmPatternSingle {
+		return Invalidf("alarm pattern %q not supported, expected %s or %s", a.Pattern, AlarmPatternDouble, AlarmPatternSingle)
+	}
+	// a minute of grace for clock drift between the client and us
+	if a.Armed() && int64(a.Time) < now.Add(-time.Minute).Unix() {
+		return Invalidf("alarm time %s is in the past", time.Unix(int64(a.Time), 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (a AlarmParams) Encode() (string, error) {
+	marshalled, err := cbor.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(marshalled), nil
+}
+
+func DecodeAlarmParams(input string) (AlarmParams, error) {
+	var alarmParams AlarmParams
+	data, err := hex.DecodeString(input)
+	if err != nil {
+		return alarmParams, Invalidf("decoding alarm hex: %w", err)
+	}
+	err = cbor.Unmarshal(data, &alarmParams)
+	if err != nil {
+		return alarmParams, Invalidf("decoding alarm: %w", err)
+	}
+	return alarmParams, nil
+}
+
+func alarmPath(side BedSide) string {
+	if side == BedSideRight {
+		return "alarmR"
+	}
+	return "alarmL"
+}
+
+// SetAlarm arms an alarm from a pod3 hex payload, as sent by free-sleep.
+func (c *PodConnection) SetAlarm(side BedSide, input string) error {
+	hexStr, err := c.translatePayload(Pod3AlarmTranslation, input)
+	if err != nil {
+		c.logger.Error("Error translating alarm params", zap.Error(err))
+		return err
+	}
+	alarmParams, err := DecodeAlarmParams(hexStr)
+	if err != nil {
+		c.logger.Error("Error decoding translated alarm params", zap.Error(err))
+		return err
+	}
+	return c.SetAlarmParams(side, alarmParams)
+}
+
+// SetAlarmParams validates and arms an alarm for one side.
+func (c *PodConnection) SetAlarmParams(side BedSide, alarmParams AlarmParams) error {
+	err := alarmParams.Validate(time.Now())
+	if err != nil {
+		c.logger.Warn("Rejected alarm", zap.Int("side", int(side)), zap.Any("alarm", alarmParams), zap.Error(err))
+		return err
+	}
+	return c.writeAlarm(side, alarmParams)
+}
+
+// ClearAlarm disarms the alarm on one side only.
+func (c *PodConnection) ClearAlarm(side BedSide) error {
+	return c.writeAlarm(side, clearedAlarm)
+}
+
+// ClearAlarms disarms both sides.
+func (c *PodConnection) ClearAlarms() error {
+	err := c.ClearAlarm(BedSideLeft)
+	if err != nil {
+		return err
+	}
+	return c.ClearAlarm(BedSideRight)
+}
+
+func (c *PodConnection) writeAlarm(side BedSide, alarmParams AlarmParams) error {
+	hexStr, err := alarmParams.Encode()
+	if err != nil {
+		c.logger.Error("Error marshalling alarm params", zap.Error(err))
+		return err
+	}
+	err = c.SetValue(alarmPath(side), hexStr)
+	if err != nil {
+		return err
+	}
+
+	c.alarmMutex.Lock()
+	c.alarms[side] = alarmParams
+	if alarmParams.Armed() {
+		c.armedAlarms[side] = alarmParams
+	}
+	c.alarmMutex.Unlock()
+	return nil
+}
+
+// RearmAlarm arms the last alarm armed on one side again, at the next occurrence of its time of day.
+func (c *PodConnection) RearmAlarm(side BedSide) error {
+	c.alarmMutex.Lock()
+	alarmParams, ok := c.armedAlarms[side]
+	c.alarmMutex.Unlock()
+	if !ok {
+		return Invalidf("no alarm has been armed on the %s side to re-arm", side)
+	}
+	alarmParams.Time = nextAlarmTime(alarmParams.Time, time.Now())
+	return c.SetAlarmParams(side, alarmParams)
+}
+
+// nextAlarmTime moves an alarm time on by whole days until it is after now, keeping its local time of day.
+func nextAlarmTime(alarmTime uint64, now time.Time) uint64 {
+	t := time.Unix(int64(alarmTime), 0).In(now.Location())
+	if t.After(now) {
+		return alarmTime
+	}
+	// AddDate rather than 24 hours so a daylight saving change doesn't move it
+	days := int(now.Sub(t).Hours() / 24)
+	next := t.AddDate(0, 0, days)
+	for !next.After(now) {
+		days++
+		next = t.AddDate(0, 0, days)
+	}
+	return uint64(next.Unix())
+}
+
+// GetAlarm returns the alarm armed on one side.  The pod is asked first, if it doesn't report a readable alarm
+// we fall back to the last alarm this server wrote.
+func (c *PodConnection) GetAlarm(side BedSide) (AlarmParams, error) {
+	data, err := c.getVariable(alarmPath(side))
+	if err == nil {
+		alarmParams, decodeErr := DecodeAlarmParams(unwrapQuotes(string(data)))
+		if decodeErr == nil {
+			return alarmParams, nil
+		}
+		err = decodeErr
+	}
+	c.logger.Debug("Could not read alarm from pod, using server state", zap.Int("side", int(side)), zap.Error(err))
+	return c.GetStoredAlarm(side), nil
+}
+
+// GetStoredAlarm returns the last alarm this server wrote for one side, or a cleared alarm if there is none.
+func (c *PodConnection) GetStoredAlarm(side BedSide) AlarmParams {
+	c.alarmMutex.Lock()
+	defer c.alarmMutex.Unlock()
+	alarmParams, ok := c.alarms[side]
+	if !ok {
+		return clearedAlarm
+	}
+	return alarmParams
+}
@@ -0,0 +1,40 @@
+package SparkServer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextAlarmTime(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	now := time.Date(2024, 3, 12, 9, 0, 0, 0, location)
+	tests := []struct {
+		name  string
+		alarm time.Time
+		want  time.Time
+	}{
+		{"still to come", time.Date(2024, 3, 12, 10, 0, 0, 0, location), time.Date(2024, 3, 12, 10, 0, 0, 0, location)},
+		{"earlier today", time.Date(2024, 3, 12, 7, 0, 0, 0, location), time.Date(2024, 3, 13, 7, 0, 0, 0, location)},
+		{"right now", now, time.Date(2024, 3, 13, 9, 0, 0, 0, location)},
+		{"before the clocks changed", time.Date(2024, 3, 8, 7, 0, 0, 0, location), time.Date(2024, 3, 13, 7, 0, 0, 0, location)},
+	}
+	for _, test := range tests {
+		got := nextAlarmTime(uint64(test.alarm.Unix()), now)
+		if got != uint64(test.want.Unix()) {
+			t.Errorf("%s: got %s, want %s", test.name, time.Unix(int64(got), 0).In(location), test.want)
+		}
+	}
+}
+
+func TestRearmAlarmWithoutAnArmedAlarm(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	c.alarms[BedSideLeft] = clearedAlarm
+	var validationError *ValidationError
+	if err := c.RearmAlarm(BedSideLeft); !errors.As(err, &validationError) {
+		t.Errorf("got %v, want a validation error", err)
+	}
+}
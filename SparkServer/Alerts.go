@@ -0,0 +1,164 @@
+package SparkServer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type AlertType string
+
+const (
+	AlertLowWater        AlertType = "low_water"
+	AlertWaterRestored   AlertType = "water_restored"
+	AlertPrimingStarted  AlertType = "priming_started"
+	AlertPrimingFinished AlertType = "priming_finished"
+	AlertPrimingStuck    AlertType = "priming_stuck"
+	AlertPodOnline       AlertType = "pod_online"
+	AlertPodOffline      AlertType = "pod_offline"
+)
+
+type Alert struct {
+	Type     AlertType `json:"type"`
+	DeviceId string    `json:"device_id"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// Notifier delivers alerts somewhere a person will see them.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// AlertDetector turns successive pod statuses into alerts on state changes.
+type AlertDetector struct {
+	previous      *PodStatus
+	primingSince  time.Time
+	stuckReported bool
+}
+
+func (d *AlertDetector) Detect(deviceId string, status PodStatus, now time.Time) []Alert {
+	var alerts []Alert
+	alert := func(alertType AlertType, message string) {
+		alerts = append(alerts, Alert{Type: alertType, DeviceId: deviceId, Message: message, Time: now})
+	}
+
+	previous := d.previous
+	d.previous = &status
+
+	// the first status only establishes a baseline, except for a tank that is already low
+	if previous == nil {
+		if !status.WaterLevel {
+			alert(AlertLowWater, "water tank is low")
+		}
+		if status.Priming {
+			d.primingSince = now
+		}
+		return alerts
+	}
+
+	if previous.WaterLevel && !status.WaterLevel {
+		alert(AlertLowWater, "water tank is low")
+	} else if !previous.WaterLevel && status.WaterLevel {
+		alert(AlertWaterRestored, "water tank has been refilled")
+	}
+
+	switch {
+	case !previous.Priming && status.Priming:
+		d.primingSince = now
+		d.stuckReported = false
+		alert(AlertPrimingStarted, "priming started")
+	case previous.Priming && !status.Priming:
+		alert(AlertPrimingFinished, fmt.Sprintf("priming finished after %s", now.Sub(d.primingSince).Round(time.Second)))
+	case status.Priming && !d.stuckReported && now.Sub(d.primingSince) > primeMaxDuration:
+		d.stuckReported = true
+		alert(AlertPrimingStuck, fmt.Sprintf("still priming after %s", now.Sub(d.primingSince).Round(time.Second)))
+	}
+	return alerts
+}
+
+// LogNotifier writes alerts to the server log.
+type LogNotifier struct {
+	logger *zap.Logger
+}
+
+func NewLogNotifier(logger *zap.Logger) *LogNotifier {
+	return &LogNotifier{logger: logger}
+}
+
+func (n *LogNotifier) Notify(alert Alert) error {
+	n.logger.Warn("Pod alert", zap.String("type", string(alert.Type)), zap.String("device_id", alert.DeviceId), zap.String("message", alert.Message))
+	return nil
+}
+
+// WebhookNotifier posts alerts as json.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *WebhookNotifier) Notify(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	res, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// CommandNotifier runs a shell command for each alert, with the alert in ALERT_* environment variables.
+type CommandNotifier struct {
+	command string
+}
+
+func NewCommandNotifier(command string) *CommandNotifier {
+	return &CommandNotifier{command: command}
+}
+
+func (n *CommandNotifier) Notify(alert Alert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", n.command)
+	cmd.Env = append(os.Environ(),
+		"ALERT_TYPE="+string(alert.Type),
+		"ALERT_DEVICE_ID="+alert.DeviceId,
+		"ALERT_MESSAGE="+alert.Message,
+		"ALERT_TIME="+alert.Time.Format(time.RFC3339),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("alert command failed: %w: %s", err, output)
+	}
+	return nil
+}
+
+// notify hands an alert to every notifier without holding up the caller.
+func (s *Server) notify(alert Alert) {
+	s.events.Publish(Event{Type: EventAlert, DeviceId: alert.DeviceId, Time: alert.Time, Data: alert})
+	for _, notifier := range s.notifiers {
+		go func(notifier Notifier) {
+			err := notifier.Notify(alert)
+			if err != nil {
+				s.logger.Error("Error sending alert", zap.String("type", string(alert.Type)), zap.Error(err))
+			}
+		}(notifier)
+	}
+}
@@ -0,0 +1,108 @@
+package SparkServer
+
+import (
+	"testing"
+	"time"
+)
+
+func alertTypes(alerts []Alert) []AlertType {
+	var types []AlertType
+	for _, alert := range alerts {
+		types = append(types, alert.Type)
+	}
+	return types
+}
+
+func TestAlertDetector(t *testing.T) {
+	start := time.Date(2024, time.March, 12, 12, 0, 0, 0, time.UTC)
+	full := PodStatus{WaterLevel: true}
+	low := PodStatus{WaterLevel: false}
+	priming := PodStatus{WaterLevel: true, Priming: true}
+
+	type step struct {
+		after  time.Duration // since start
+		status PodStatus
+		want   []AlertType
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"first status is only a baseline", []step{
+			{0, full, nil},
+			{time.Minute, full, nil},
+		}},
+		{"tank already low on the first status", []step{
+			{0, low, []AlertType{AlertLowWater}},
+			{time.Minute, low, nil},
+		}},
+		{"tank runs low and is refilled", []step{
+			{0, full, nil},
+			{time.Minute, low, []AlertType{AlertLowWater}},
+			{2 * time.Minute, low, nil},
+			{3 * time.Minute, full, []AlertType{AlertWaterRestored}},
+		}},
+		{"priming starts and finishes", []step{
+			{0, full, nil},
+			{time.Minute, priming, []AlertType{AlertPrimingStarted}},
+			{10 * time.Minute, priming, nil},
+			{11 * time.Minute, full, []AlertType{AlertPrimingFinished}},
+		}},
+		{"priming stuck is reported once", []step{
+			{0, full, nil},
+			{time.Minute, priming, []AlertType{AlertPrimingStarted}},
+			{time.Minute + primeMaxDuration, priming, nil},
+			{2*time.Minute + primeMaxDuration, priming, []AlertType{AlertPrimingStuck}},
+			{3*time.Minute + primeMaxDuration, priming, nil},
+			{4*time.Minute + primeMaxDuration, full, []AlertType{AlertPrimingFinished}},
+		}},
+		{"priming when first seen counts from then", []step{
+			{0, priming, nil},
+			{primeMaxDuration + time.Minute, priming, []AlertType{AlertPrimingStuck}},
+		}},
+		{"a new prime can be reported stuck again", []step{
+			{0, priming, nil},
+			{primeMaxDuration + time.Minute, priming, []AlertType{AlertPrimingStuck}},
+			{primeMaxDuration + 2*time.Minute, full, []AlertType{AlertPrimingFinished}},
+			{primeMaxDuration + 3*time.Minute, priming, []AlertType{AlertPrimingStarted}},
+			{2*primeMaxDuration + 4*time.Minute, priming, []AlertType{AlertPrimingStuck}},
+		}},
+		{"low water while priming", []step{
+			{0, priming, nil},
+			{time.Minute, PodStatus{Priming: true}, []AlertType{AlertLowWater}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := AlertDetector{}
+			for i, step := range test.steps {
+				alerts := detector.Detect("pod", step.status, start.Add(step.after))
+				got := alertTypes(alerts)
+				if len(got) != len(step.want) {
+					t.Fatalf("step %d: got %v, want %v", i, got, step.want)
+				}
+				for j := range got {
+					if got[j] != step.want[j] {
+						t.Fatalf("step %d: got %v, want %v", i, got, step.want)
+					}
+				}
+				for _, alert := range alerts {
+					if alert.DeviceId != "pod" || !alert.Time.Equal(start.Add(step.after)) {
+						t.Errorf("step %d: got %+v, want it for the pod at the time of the status", i, alert)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPrimingFinishedReportsDuration(t *testing.T) {
+	start := time.Date(2024, time.March, 12, 12, 0, 0, 0, time.UTC)
+	detector := AlertDetector{}
+	detector.Detect("pod", PodStatus{WaterLevel: true}, start)
+	detector.Detect("pod", PodStatus{WaterLevel: true, Priming: true}, start.Add(time.Minute))
+	alerts := detector.Detect("pod", PodStatus{WaterLevel: true}, start.Add(13*time.Minute+30*time.Second))
+	if len(alerts) != 1 || alerts[0].Message != "priming finished after 12m30s" {
+		t.Fatalf("got %+v", alerts)
+	}
+}
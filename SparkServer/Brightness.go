@@ -0,0 +1,117 @@
+package SparkServer
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+The only LED control the pod 2 exposes is the brightness field (lb) of the settings blob, 0 being off.  Its scale
+isn't documented anywhere, so values are passed through as given.
+Changing it is a read/modify/write of the settings so the gains are left alone.
+*/
+
+func (c *PodConnection) GetBrightness() (int, error) {
+	settings, err := c.GetSettings()
+	if err != nil {
+		return 0, err
+	}
+	return settings.LedBrightness, nil
+}
+
+func (c *PodConnection) SetBrightness(level int) error {
+	if level < 0 {
+		return Invalidf("brightness %d can't be negative", level)
+	}
+	return c.UpdateSettings(func(settings *PodSettings) {
+		settings.LedBrightness = level
+	})
+}
+
+// DimmingSchedule switches the LED between a day and a night brightness at fixed times of day.
+type DimmingSchedule struct {
+	NightStart      time.Duration // offset from local midnight
+	NightEnd        time.Duration
+	NightBrightness int
+	DayBrightness   int
+}
+
+// ParseDimmingSchedule builds a schedule from "HH:MM" start and end times.
+func ParseDimmingSchedule(nightStart string, nightEnd string, nightBrightness int, dayBrightness int) (*DimmingSchedule, error) {
+	start, err := parseTimeOfDay(nightStart)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(nightEnd)
+	if err != nil {
+		return nil, err
+	}
+	if nightBrightness < 0 {
+		return nil, Invalidf("night brightness %d can't be negative", nightBrightness)
+	}
+	if dayBrightness < 0 {
+		return nil, Invalidf("day brightness %d can't be negative", dayBrightness)
+	}
+	return &DimmingSchedule{
+		NightStart:      start,
+		NightEnd:        end,
+		NightBrightness: nightBrightness,
+		DayBrightness:   dayBrightness,
+	}, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, Invalidf("invalid time of day %q, expected HH:MM: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// IsNight reports whether t falls within the night period, which may wrap past midnight.
+func (d *DimmingSchedule) IsNight(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if d.NightStart <= d.NightEnd {
+		return offset >= d.NightStart && offset < d.NightEnd
+	}
+	return offset >= d.NightStart || offset < d.NightEnd
+}
+
+func (d *DimmingSchedule) BrightnessAt(t time.Time) int {
+	if d.IsNight(t) {
+		return d.NightBrightness
+	}
+	return d.DayBrightness
+}
+
+// runDimmingSchedule applies the brightness for the current period on connect, and again at every
+// day/night transition.  Manual changes in between are left alone.
+func (c *PodConnection) runDimmingSchedule(schedule *DimmingSchedule) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	applied := false
+	lastNight := false
+	for {
+		now := time.Now()
+		night := schedule.IsNight(now)
+		if !applied || night != lastNight {
+			level := schedule.BrightnessAt(now)
+			err := c.SetBrightness(level)
+			if err != nil {
+				c.logger.Error("Error applying scheduled brightness", zap.Int("brightness", level), zap.Error(err))
+			} else {
+				c.logger.Info("Applied scheduled brightness", zap.Int("brightness", level), zap.Bool("night", night))
+				applied = true
+				lastNight = night
+			}
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
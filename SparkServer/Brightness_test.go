@@ -0,0 +1,92 @@
+package SparkServer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDimmingScheduleIsNight(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, time.March, 5, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		t     time.Time
+		night bool
+	}{
+		{"before a same day night", "01:00", "05:00", at(0, 59), false},
+		{"start of a same day night", "01:00", "05:00", at(1, 0), true},
+		{"end of a same day night", "01:00", "05:00", at(5, 0), false},
+		{"evening of a night past midnight", "22:30", "07:00", at(23, 15), true},
+		{"start of a night past midnight", "22:30", "07:00", at(22, 30), true},
+		{"just before a night past midnight", "22:30", "07:00", at(22, 29), false},
+		{"midnight in a night past midnight", "22:30", "07:00", at(0, 0), true},
+		{"morning of a night past midnight", "22:30", "07:00", at(6, 59), true},
+		{"end of a night past midnight", "22:30", "07:00", at(7, 0), false},
+		{"midday with a night past midnight", "22:30", "07:00", at(12, 0), false},
+		{"empty night", "07:00", "07:00", at(7, 0), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseDimmingSchedule(test.start, test.end, 5, 80)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.IsNight(test.t); got != test.night {
+				t.Errorf("IsNight(%s) = %t, want %t", test.t.Format("15:04"), got, test.night)
+			}
+			want := 80
+			if test.night {
+				want = 5
+			}
+			if got := schedule.BrightnessAt(test.t); got != want {
+				t.Errorf("BrightnessAt(%s) = %d, want %d", test.t.Format("15:04"), got, want)
+			}
+		})
+	}
+}
+
+func TestParseDimmingScheduleRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		start      string
+		end        string
+		night, day int
+	}{
+		{"bad start", "22h30", "07:00", 0, 100},
+		{"bad end", "22:30", "25:00", 0, 100},
+		{"negative night brightness", "22:30", "07:00", -1, 100},
+		{"negative day brightness", "22:30", "07:00", 0, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseDimmingSchedule(test.start, test.end, test.night, test.day)
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("got %v, want a validation error", err)
+			}
+		})
+	}
+}
+
+func TestParseDimmingScheduleKeepsBrightness(t *testing.T) {
+	// the pod's scale is unknown, so a brightness above 100 is left to the pod
+	schedule, err := ParseDimmingSchedule("22:30", "07:00", 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule.DayBrightness != 200 {
+		t.Errorf("got day brightness %d, want 200", schedule.DayBrightness)
+	}
+}
+
+func TestSetBrightnessRejectsNegative(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	var validationErr *ValidationError
+	if err := c.SetBrightness(-1); !errors.As(err, &validationErr) {
+		t.Fatalf("got %v, want a validation error", err)
+	}
+}
@@ -0,0 +1,109 @@
+package SparkServer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+The pod's cbor maps are edited a field at a time rather than decoded into a go map and encoded again, so the fields
+keep the order they came in and whatever we don't change goes back to the pod exactly as it was.
+*/
+
+var errNotCborMap = errors.New("not a cbor map")
+
+// cborPair is one entry of a cbor map, as the encoded key and value.
+type cborPair struct {
+	name  string
+	key   cbor.RawMessage
+	value cbor.RawMessage
+}
+
+// decodeCborMap splits a cbor map with string keys into its entries, in order.
+func decodeCborMap(data []byte) ([]cborPair, error) {
+	if len(data) == 0 || data[0]>>5 != 5 {
+		return nil, errNotCborMap
+	}
+	count, offset := -1, 1 // -1 until the break for an indefinite length map
+	switch info := data[0] & 0x1f; {
+	case info < 24:
+		count = int(info)
+	case info == 24 && len(data) >= 2:
+		count, offset = int(data[1]), 2
+	case info == 25 && len(data) >= 3:
+		count, offset = int(binary.BigEndian.Uint16(data[1:])), 3
+	case info == 26 && len(data) >= 5:
+		count, offset = int(binary.BigEndian.Uint32(data[1:])), 5
+	case info == 31:
+	default:
+		return nil, fmt.Errorf("%w: bad length", errNotCborMap)
+	}
+
+	rest := data[offset:]
+	decoder := cbor.NewDecoder(bytes.NewReader(rest))
+	var pairs []cborPair
+	for count < 0 || len(pairs) < count {
+		if count < 0 {
+			read := decoder.NumBytesRead()
+			if read < len(rest) && rest[read] == 0xff {
+				break
+			}
+		}
+		var pair cborPair
+		err := decoder.Decode(&pair.key)
+		if err == nil {
+			err = decoder.Decode(&pair.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = cbor.Unmarshal(pair.key, &pair.name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: non string key", errNotCborMap)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// encodeCborMap is the reverse of decodeCborMap, always giving a definite length map.
+func encodeCborMap(pairs []cborPair) []byte {
+	var output []byte
+	switch n := len(pairs); {
+	case n < 24:
+		output = append(output, 0xa0|byte(n))
+	case n < 256:
+		output = append(output, 0xb8, byte(n))
+	default:
+		output = binary.BigEndian.AppendUint16(append(output, 0xb9), uint16(n))
+	}
+	for _, pair := range pairs {
+		output = append(output, pair.key...)
+		output = append(output, pair.value...)
+	}
+	return output
+}
+
+// newCborPair encodes a new entry for a map.
+func newCborPair(key string, value interface{}) (cborPair, error) {
+	encodedKey, err := cbor.Marshal(key)
+	if err != nil {
+		return cborPair{}, err
+	}
+	encodedValue, err := cbor.Marshal(value)
+	if err != nil {
+		return cborPair{}, err
+	}
+	return cborPair{name: key, key: encodedKey, value: encodedValue}, nil
+}
+
+// decodeValue decodes the entry's value.
+func (p cborPair) decodeValue() (interface{}, error) {
+	var value interface{}
+	err := cbor.Unmarshal(p.value, &value)
+	return value, err
+}
@@ -1,18 +1,23 @@
 package SparkServer
 
 import (
-	"encoding/hex"
 	"strconv"
 
-	"github.com/fxamacker/cbor/v2"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"go.uber.org/zap"
 )
 
 type BedStatus struct {
 	HeatTime        int `json:"heat_time"`
 	HeatLevel       int `json:"heat_level"`
 	TargetHeatLevel int `json:"target_heat_level"`
+
+	HeatTemperature   Temperature `json:"heat_temperature"`
+	TargetTemperature Temperature `json:"target_temperature"`
+
+	ProgramStep *ProgramStepStatus `json:"program_step,omitempty"`
+	Ramp        *RampStatus        `json:"ramp,omitempty"`
 }
 
 type BedSide int
@@ -22,6 +27,23 @@ const (
 	BedSideRight BedSide = 1
 )
 
+func ParseBedSide(s string) (BedSide, error) {
+	switch s {
+	case "left", "l", "0":
+		return BedSideLeft, nil
+	case "right", "r", "1":
+		return BedSideRight, nil
+	}
+	return BedSideLeft, Invalidf("unknown side %q, expected left or right", s)
+}
+
+func (side BedSide) String() string {
+	if side == BedSideRight {
+		return "right"
+	}
+	return "left"
+}
+
 type PodStatus struct {
 	Priming    bool `json:"priming"`
 	WaterLevel bool `json:"water_level"`
@@ -37,6 +59,8 @@ type PodStatus struct {
 	IpAddress      string `json:"ip_address"`
 	SignalStrength string `json:"signal_strength"`
 	Settings       string `json:"settings"`
+
+	DecodedSettings *PodSettings `json:"decoded_settings,omitempty"`
 }
 
 func (c *PodConnection) GetStatus() (PodStatus, error) {
@@ -49,7 +73,7 @@ func (c *PodConnection) GetStatus() (PodStatus, error) {
 
 	hlL, err := strconv.Atoi(string(heatLevelLeft[:]))
 	if err != nil {
-		println("Error parsing heat level left:", err)
+		c.logger.Warn("Error parsing heat level left", zap.Error(err))
 	} else {
 		status.LeftBed.HeatLevel = hlL
 	}
@@ -57,7 +81,7 @@ func (c *PodConnection) GetStatus() (PodStatus, error) {
 	heatLevelRight := getData(c, "heatLevelR")
 	hlR, err := strconv.Atoi(string(heatLevelRight[:]))
 	if err != nil {
-		println("Error parsing heat level right:", err)
+		c.logger.Warn("Error parsing heat level right", zap.Error(err))
 	} else {
 		status.RightBed.HeatLevel = hlR
 	}
@@ -65,7 +89,7 @@ func (c *PodConnection) GetStatus() (PodStatus, error) {
 	targetHeatLevelLeft := getData(c, "tgHeatLevelL")
 	thlL, err := strconv.Atoi(string(targetHeatLevelLeft[:]))
 	if err != nil {
-		println("Error parsing target heat level left:", err)
+		c.logger.Warn("Error parsing target heat level left", zap.Error(err))
 	} else {
 		status.LeftBed.TargetHeatLevel = thlL
 	}
@@ -73,7 +97,7 @@ func (c *PodConnection) GetStatus() (PodStatus, error) {
 	targetHeatLevelRight := getData(c, "tgHeatLevelR")
 	thlR, err := strconv.Atoi(string(targetHeatLevelRight[:]))
 	if err != nil {
-		println("Error parsing target heat level right:", err)
+		c.logger.Warn("Error parsing target heat level right", zap.Error(err))
 	} else {
 		status.RightBed.TargetHeatLevel = thlR
 	}
@@ -81,26 +105,33 @@ func (c *PodConnection) GetStatus() (PodStatus, error) {
 	heatTimeLeft := getData(c, "heatTimeL")
 	htL, err := strconv.Atoi(string(heatTimeLeft[:]))
 	if err != nil {
-		println("Error parsing heat time left:", err)
+		c.logger.Warn("Error parsing heat time left", zap.Error(err))
 	} else {
 		status.LeftBed.HeatTime = htL
 	}
 	heatTimeRight := getData(c, "heatTimeR")
 	htR, err := strconv.Atoi(string(heatTimeRight[:]))
 	if err != nil {
-		println("Error parsing heat time right:", err)
+		c.logger.Warn("Error parsing heat time right", zap.Error(err))
 	} else {
 		status.RightBed.HeatTime = htR
 	}
 
-	priming := getData(c, "priming")
+	// an alert on low water or priming shouldn't come from a request that failed, so these two must succeed
+	priming, err := c.getVariable("priming")
+	if err != nil {
+		return status, err
+	}
 	if string(priming[:]) == "true" {
 		status.Priming = true
 	} else {
 		status.Priming = false
 	}
 
-	waterLevel := getData(c, "waterLevel")
+	waterLevel, err := c.getVariable("waterLevel")
+	if err != nil {
+		return status, err
+	}
 	if string(waterLevel[:]) == "true" {
 		status.WaterLevel = true
 	} else {
@@ -133,20 +164,42 @@ func (c *PodConnection) GetStatus() (PodStatus, error) {
 
 	settings := getData(c, "settings")
 	status.Settings = unwrapQuotes(string(settings[:]))
+	decodedSettings, err := DecodePodSettings(status.Settings)
+	if err != nil {
+		c.logger.Warn("Error decoding settings", zap.String("settings", status.Settings), zap.Error(err))
+	} else {
+		status.DecodedSettings = &decodedSettings
+	}
+
+	calibration := c.calibration.Get()
+	status.LeftBed.HeatTemperature = calibration.Temperature(status.LeftBed.HeatLevel, BedSideLeft)
+	status.LeftBed.TargetTemperature = calibration.Temperature(status.LeftBed.TargetHeatLevel, BedSideLeft)
+	status.RightBed.HeatTemperature = calibration.Temperature(status.RightBed.HeatLevel, BedSideRight)
+	status.RightBed.TargetTemperature = calibration.Temperature(status.RightBed.TargetHeatLevel, BedSideRight)
+
+	status.LeftBed.ProgramStep = c.ProgramStep(BedSideLeft)
+	status.RightBed.ProgramStep = c.ProgramStep(BedSideRight)
+	status.LeftBed.Ramp = c.Ramp(BedSideLeft)
+	status.RightBed.Ramp = c.Ramp(BedSideRight)
 
 	return status, nil
 }
 
 func getData(c *PodConnection, verb string) []byte {
+	data, err := c.getVariable(verb)
+	if err != nil {
+		c.logger.Error("Error reading pod variable", zap.String("variable", verb), zap.Error(err))
+	}
+	return data
+}
+
+func (c *PodConnection) getVariable(verb string) ([]byte, error) {
 	msg := message.Message{
 		Options: message.Options{{ID: message.URIPath, Value: []byte("v")}, {ID: message.URIPath, Value: []byte(verb)}},
 		Code:    codes.GET,
 		Type:    message.Confirmable,
 	}
-	podReq := NewPodRequest(&msg)
-	c.RequestPipe <- podReq
-	<-podReq.Ready
-	return podReq.Response
+	return c.doRequest(&msg)
 }
 
 func unwrapQuotes(s string) string {
@@ -160,25 +213,51 @@ func unwrapQuotes(s string) string {
 	return s
 }
 
-func (c *PodConnection) SetTime(seconds int, side BedSide) {
+func (c *PodConnection) SetTime(seconds int, side BedSide) error {
+	return c.SetTimeFrom(SourceServer, seconds, side)
+}
+
+func (c *PodConnection) SetTimeFrom(source CommandSource, seconds int, side BedSide) error {
 	path := "leftHeat"
 	if side == BedSideRight {
 		path = "rightHeat"
 	}
 	value := strconv.Itoa(seconds)
-	c.SetValue(path, value)
+	return c.SetValueFrom(source, path, value)
 }
 
-func (c *PodConnection) SetLevel(level int, side BedSide) {
+func (c *PodConnection) SetLevel(level int, side BedSide) error {
+	return c.SetLevelFrom(SourceServer, level, side)
+}
+
+func (c *PodConnection) SetLevelFrom(source CommandSource, level int, side BedSide) error {
 	path := "leftLevel"
 	if side == BedSideRight {
 		path = "rightLevel"
 	}
 	value := strconv.Itoa(level)
-	c.SetValue(path, value)
+	return c.SetValueFrom(source, path, value)
+}
+
+// ProgramStep returns the temperature program step a side is running, nil if none.
+func (c *PodConnection) ProgramStep(side BedSide) *ProgramStepStatus {
+	c.programMutex.Lock()
+	defer c.programMutex.Unlock()
+	return c.programSteps[side]
+}
+
+func (c *PodConnection) setProgramStep(side BedSide, step *ProgramStepStatus) {
+	c.programMutex.Lock()
+	defer c.programMutex.Unlock()
+	c.programSteps[side] = step
+}
+
+func (c *PodConnection) SetValue(path string, value string) error {
+	return c.SetValueFrom(SourceServer, path, value)
 }
 
-func (c *PodConnection) SetValue(path string, value string) {
+// callFunction sends a write to the pod as is, use SetValue/SetValueFrom so it gets checked first.
+func (c *PodConnection) callFunction(path string, value string) error {
 	msg := message.Message{
 		Options: message.Options{
 			{ID: message.URIPath, Value: []byte("f")},
@@ -188,68 +267,22 @@ func (c *PodConnection) SetValue(path string, value string) {
 		Code: codes.POST,
 		Type: message.Confirmable,
 	}
-	podReq := NewPodRequest(&msg)
-	c.RequestPipe <- podReq
-	<-podReq.Ready
-	println("done setting", path, "to", value)
-}
-
-type AlarmParams struct {
-	Intensity int    `cbor:"pl"`
-	Duration  int    `cbor:"du"`
-	Time      uint64 `cbor:"tt"`
-	Pattern   string `cbor:"pi"`
-}
-
-func (c *PodConnection) SetAlarm(side BedSide, input string) {
-	// need to verify the pattern field, pod 2 has double or single, other versions have double/rise
-	// so we need to swap any "rise" to "single" or it'll error out
-	data, err := hex.DecodeString(input)
-	if err != nil {
-		println("Error decoding alarm params hex:", err)
-		return
-	}
-	var alarmParams AlarmParams
-	err = cbor.Unmarshal(data, &alarmParams)
+	_, err := c.doRequest(&msg)
 	if err != nil {
-		println("Error unmarshalling alarm params:", err)
-		return
+		c.logger.Error("Error setting pod value", zap.String("path", path), zap.String("value", value), zap.Error(err))
+		return err
 	}
-
-	if alarmParams.Pattern == "rise" {
-		alarmParams.Pattern = "single"
-	}
-
-	marshalled, err := cbor.Marshal(alarmParams)
-	if err != nil {
-		println("Error marshalling alarm params:", err)
-		return
-	}
-
-	path := "alarmL"
-	if side == BedSideRight {
-		path = "alarmR"
-	}
-
-	hexStr := hex.EncodeToString(marshalled)
-
-	c.SetValue(path, hexStr)
+	c.logger.Debug("Set pod value", zap.String("path", path), zap.String("value", value))
+	return nil
 }
 
-func (c *PodConnection) ClearAlarms() {
-	payload := AlarmParams{
-		Intensity: 0,
-		Duration:  600,
-		Time:      0,
-		Pattern:   "double",
-	}
-	marshalled, err := cbor.Marshal(payload)
+func (c *PodConnection) SetSettings(input string) error {
+	hexStr, err := c.translatePayload(Pod3SettingsTranslation, input)
 	if err != nil {
-		println("Error marshalling clear alarm params:", err)
-		return
+		c.logger.Error("Error translating settings", zap.String("settings", input), zap.Error(err))
+		return err
 	}
-	hexStr := hex.EncodeToString(marshalled)
-
-	c.SetValue("alarmL", hexStr)
-	c.SetValue("alarmR", hexStr)
+	c.settingsMutex.Lock()
+	defer c.settingsMutex.Unlock()
+	return c.SetValue("setsettings", hexStr)
 }
@@ -0,0 +1,109 @@
+package SparkServer
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventConnected     EventType = "connected"
+	EventDisconnected  EventType = "disconnected"
+	EventStatus        EventType = "status"         // a full status, sent to new subscribers
+	EventStatusChanged EventType = "status_changed" // the fields that changed between two reads of the status
+	EventCommand       EventType = "command"        // a write the pod accepted
+	EventAlert         EventType = "alert"
+)
+
+type Event struct {
+	Type     EventType   `json:"type"`
+	DeviceId string      `json:"device_id"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+type StatusChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type CommandEvent struct {
+	Source CommandSource `json:"source"`
+	Path   string        `json:"path"`
+	Value  string        `json:"value"`
+}
+
+// EventBus fans events out to subscribers.  A subscriber that falls behind misses events rather than holding up
+// the pod.
+type EventBus struct {
+	subscribers map[chan Event]struct{}
+	mutex       sync.Mutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel of events and a function to stop receiving them.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			delete(b.subscribers, ch)
+			b.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// DiffStatus lists the fields that differ between two statuses, named as in the status json.
+func DiffStatus(previous PodStatus, current PodStatus) []StatusChange {
+	var changes []StatusChange
+	add := func(field string, from interface{}, to interface{}) {
+		if !reflect.DeepEqual(from, to) {
+			changes = append(changes, StatusChange{Field: field, From: from, To: to})
+		}
+	}
+	add("priming", previous.Priming, current.Priming)
+	add("water_level", previous.WaterLevel, current.WaterLevel)
+	add("settings", previous.Settings, current.Settings)
+	sides := []struct {
+		name     string
+		previous BedStatus
+		current  BedStatus
+	}{
+		{"left_side", previous.LeftBed, current.LeftBed},
+		{"right_side", previous.RightBed, current.RightBed},
+	}
+	for _, side := range sides {
+		add(side.name+".heat_level", side.previous.HeatLevel, side.current.HeatLevel)
+		add(side.name+".target_heat_level", side.previous.TargetHeatLevel, side.current.TargetHeatLevel)
+		add(side.name+".heat_time", side.previous.HeatTime, side.current.HeatTime)
+		add(side.name+".program_step", side.previous.ProgramStep, side.current.ProgramStep)
+		add(side.name+".ramp", side.previous.Ramp, side.current.Ramp)
+	}
+	return changes
+}
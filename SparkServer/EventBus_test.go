@@ -0,0 +1,122 @@
+package SparkServer
+
+import (
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+func TestEventBusFansOut(t *testing.T) {
+	bus := NewEventBus()
+	var subscriptions []<-chan Event
+	for i := 0; i < 3; i++ {
+		events, unsubscribe := bus.Subscribe()
+		defer unsubscribe()
+		subscriptions = append(subscriptions, events)
+	}
+
+	bus.Publish(Event{Type: EventConnected, DeviceId: "pod"})
+	bus.Publish(Event{Type: EventDisconnected, DeviceId: "pod"})
+	for i, events := range subscriptions {
+		for _, want := range []EventType{EventConnected, EventDisconnected} {
+			if event := receive(t, events); event.Type != want || event.DeviceId != "pod" {
+				t.Errorf("subscriber %d got %+v, want %s", i, event, want)
+			}
+		}
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	other, unsubscribeOther := bus.Subscribe()
+	defer unsubscribeOther()
+
+	unsubscribe()
+	if _, open := <-events; open {
+		t.Error("channel still open after unsubscribing")
+	}
+	// a second call is harmless, and publishing carries on for everyone else
+	unsubscribe()
+	bus.Publish(Event{Type: EventAlert})
+	if event := receive(t, other); event.Type != EventAlert {
+		t.Errorf("got %+v, want the alert", event)
+	}
+}
+
+func TestEventBusSlowSubscriberMissesEvents(t *testing.T) {
+	bus := NewEventBus()
+	slow, unsubscribeSlow := bus.Subscribe()
+	defer unsubscribeSlow()
+	other, unsubscribeOther := bus.Subscribe()
+	defer unsubscribeOther()
+
+	// neither reads, publishing mustn't wait for them
+	const published = 200
+	finished := make(chan struct{})
+	go func() {
+		for i := 0; i < published; i++ {
+			bus.Publish(Event{Type: EventCommand, Data: i})
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("publishing was held up by subscribers that don't read")
+	}
+	if len(slow) != cap(slow) {
+		t.Errorf("slow subscriber has %d events queued, want its buffer of %d full", len(slow), cap(slow))
+	}
+	if first := receive(t, slow); first.Data != 0 {
+		t.Errorf("slow subscriber's first event is %v, want the oldest", first.Data)
+	}
+
+	// once the other subscriber catches up it gets new events, however far behind the slow one is
+	for len(other) > 0 {
+		<-other
+	}
+	bus.Publish(Event{Type: EventAlert})
+	if event := receive(t, other); event.Type != EventAlert {
+		t.Errorf("got %+v, want the alert published after catching up", event)
+	}
+}
+
+func TestEventBusNilIsSilent(t *testing.T) {
+	var bus *EventBus
+	bus.Publish(Event{Type: EventAlert})
+}
+
+func TestCommandRefreshesStatus(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	c.events = NewEventBus()
+	events, unsubscribe := c.events.Subscribe()
+	defer unsubscribe()
+	writes := answerPod(t, c)
+	defer close(c.done)
+
+	err := c.SetLevelFrom(SourceApi, 10, BedSideLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextWrite(t, writes)
+	event := receive(t, events)
+	if command, ok := event.Data.(CommandEvent); event.Type != EventCommand || !ok || command.Path != "leftLevel" || command.Value != "10" {
+		t.Errorf("got %+v, want the command", event)
+	}
+	select {
+	case <-c.statusRefresh:
+	default:
+		t.Error("status wasn't refreshed after the command")
+	}
+}
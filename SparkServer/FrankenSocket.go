@@ -10,13 +10,18 @@ import (
 	"go.uber.org/zap"
 )
 
+// connectToUnixSocket keeps free-sleep connected to this pod until the pod disconnects.
 func (c *PodConnection) connectToUnixSocket() {
 	for {
 		c.logger.Debug("Connecting to unix socket")
 		c.processUnixSocket()
 		c.logger.Debug("Disconnected from unix socket, retrying in 5 seconds...")
 		// wait 5 seconds before trying to reconnect
-		<-time.After(5 * time.Second)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(5 * time.Second):
+		}
 	}
 }
 
@@ -33,6 +38,17 @@ func (c *PodConnection) processUnixSocket() {
 		}
 	}()
 
+	// a read blocks until free-sleep sends something, so it is cut short once the pod is gone
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-c.done:
+			_ = socket.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
 	c.logger.Info("Connected to FrankenSocket unix socket", zap.String("socketPath", c.socketPath))
 	buf := make([]byte, 4096)
 	for {
@@ -50,12 +66,22 @@ func (c *PodConnection) processUnixSocket() {
 			continue
 		}
 		cmd := FrankenCommand(intVersion)
+		// only known names, so whatever is sent can't add labels
+		frankenCommandsTotal.WithLabelValues(cmd.String()).Inc()
 		switch cmd {
 		case FrankenCmdDeviceStatus:
 			res, err := c.GetStatus()
 			if err != nil {
-				c.logger.Error("Error getting pod status", zap.Error(err))
-				continue
+				// free-sleep waits for a reply, so give it the last status while it can still be trusted
+				last := c.recentStatus(time.Now())
+				if last == nil {
+					c.logger.Error("Error getting pod status", zap.Error(err))
+					continue
+				}
+				c.logger.Warn("Error getting pod status, replying with the last status", zap.Error(err))
+				res = *last
+			} else {
+				c.recordStatus(res, time.Now())
 			}
 			output := fmt.Sprintf(
 				"tgHeatLevelR = %d\ntgHeatLevelL = %d\nheatTimeR = %d\nheatTimeL = %d\nheatLevelR = %d\nheatLevelL = %d\nsensorLabel = %s\nwaterLevel = %t\npriming = %t\nsettings = %s\n\n",
@@ -78,24 +104,35 @@ func (c *PodConnection) processUnixSocket() {
 				c.logger.Error("Error converting left temp duration arg to int", zap.String("arg", parts[1]), zap.Error(err))
 				continue
 			}
-			c.SetTime(arg, BedSideLeft)
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err = c.SetTimeFrom(SourceFreeSleep, arg, BedSideLeft)
+			if err == nil && arg == 0 {
+				// turning the side off
+				c.manualOverride(BedSideLeft)
+			}
+			c.reply(socket, err)
 		case FrankenCmdRightTempDur:
 			arg, err := strconv.Atoi(parts[1])
 			if err != nil {
 				c.logger.Error("Error converting right temp duration arg to int", zap.String("arg", parts[1]), zap.Error(err))
 				continue
 			}
-			c.SetTime(arg, BedSideRight)
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err = c.SetTimeFrom(SourceFreeSleep, arg, BedSideRight)
+			if err == nil && arg == 0 {
+				// turning the side off
+				c.manualOverride(BedSideRight)
+			}
+			c.reply(socket, err)
 		case FrankenCmdTempLevelLeft:
 			arg, err := strconv.Atoi(parts[1])
 			if err != nil {
 				c.logger.Error("Error converting left temp level arg to int", zap.String("arg", parts[1]), zap.Error(err))
 				continue
 			}
-			c.SetLevel(arg, BedSideLeft)
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err = c.SetLevelFrom(SourceFreeSleep, arg, BedSideLeft)
+			if err == nil {
+				c.manualOverride(BedSideLeft)
+			}
+			c.reply(socket, err)
 
 		case FrankenCmdTempLevelRight:
 			arg, err := strconv.Atoi(parts[1])
@@ -103,31 +140,54 @@ func (c *PodConnection) processUnixSocket() {
 				c.logger.Error("Error converting right temp level arg to int", zap.String("arg", parts[1]), zap.Error(err))
 				continue
 			}
-			c.SetLevel(arg, BedSideRight)
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err = c.SetLevelFrom(SourceFreeSleep, arg, BedSideRight)
+			if err == nil {
+				c.manualOverride(BedSideRight)
+			}
+			c.reply(socket, err)
 
 		case FrankenCmdPrime:
-			c.SetValue("prime", "true")
-			_, _ = socket.Write([]byte("ok\n\n"))
+			c.reply(socket, c.Prime(SourceFreeSleep))
 
 		case FrankenCmdAlarmLeft:
-			c.SetAlarm(BedSideLeft, parts[1])
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err := c.Allow(SourceFreeSleep)
+			if err == nil {
+				err = c.SetAlarm(BedSideLeft, parts[1])
+			}
+			c.reply(socket, err)
 
 		case FrankenCmdAlarmRight:
-			c.SetAlarm(BedSideRight, parts[1])
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err := c.Allow(SourceFreeSleep)
+			if err == nil {
+				err = c.SetAlarm(BedSideRight, parts[1])
+			}
+			c.reply(socket, err)
 
 		case FrankenCmdAlarmClear:
-			c.ClearAlarms()
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err := c.Allow(SourceFreeSleep)
+			if err == nil {
+				err = c.ClearAlarms()
+			}
+			c.reply(socket, err)
 
 		case FrankenCmdSetSettings:
-			c.SetValue("setsettings", parts[1])
-			_, _ = socket.Write([]byte("ok\n\n"))
+			err := c.Allow(SourceFreeSleep)
+			if err == nil {
+				err = c.SetSettings(parts[1])
+			}
+			c.reply(socket, err)
 
 		default:
 			c.logger.Warn("Unhandled FrankenCommand from unix socket", zap.Int("command", intVersion))
 		}
 	}
 }
+
+// reply answers a command with "ok" as it always has, free-sleep doesn't expect anything else, so a failure is only
+// logged.
+func (c *PodConnection) reply(socket net.Conn, err error) {
+	if err != nil {
+		c.logger.Warn("FrankenSocket command failed", zap.Error(err))
+	}
+	_, _ = socket.Write([]byte("ok\n\n"))
+}
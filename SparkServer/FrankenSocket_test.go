@@ -0,0 +1,86 @@
+package SparkServer
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketLoopStopsWithThePod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "franken.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c := NewPodConnection(nil, nil, path)
+	finished := make(chan struct{})
+	go func() {
+		c.connectToUnixSocket()
+		close(finished)
+	}()
+
+	// connected and waiting on free-sleep
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("never connected to the socket")
+	}
+
+	close(c.done)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("socket loop kept running after the pod disconnected")
+	}
+}
+
+func TestUnixSocketLoopStopsWhileRetrying(t *testing.T) {
+	c := NewPodConnection(nil, nil, filepath.Join(t.TempDir(), "missing.sock"))
+	finished := make(chan struct{})
+	go func() {
+		c.connectToUnixSocket()
+		close(finished)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(c.done)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("socket loop kept retrying after the pod disconnected")
+	}
+}
+
+func TestRecentStatus(t *testing.T) {
+	now := time.Now()
+	c := NewPodConnection(nil, nil, "")
+	if c.recentStatus(now) != nil {
+		t.Fatal("got a status before any was read")
+	}
+
+	c.recordStatus(PodStatus{SensorLabel: "old"}, now.Add(-maxStatusAge-time.Second))
+	if c.recentStatus(now) != nil {
+		t.Error("got a status older than maxStatusAge")
+	}
+
+	c.recordStatus(PodStatus{SensorLabel: "fresh"}, now.Add(-time.Minute))
+	if status := c.recentStatus(now); status == nil || status.SensorLabel != "fresh" {
+		t.Errorf("got %+v, want the fresh status", status)
+	}
+
+	close(c.done)
+	if c.recentStatus(now) != nil {
+		t.Error("got a status after the pod disconnected")
+	}
+}
@@ -0,0 +1,102 @@
+package SparkServer
+
+import (
+	"strings"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	podConnectedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eightsleep_pod_connected",
+		Help: "Whether the pod is connected and ready (1) or not (0).",
+	}, []string{"device_id"})
+	handshakesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eightsleep_handshakes_total",
+		Help: "Pod handshakes by result.",
+	}, []string{"result"})
+	coapRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eightsleep_coap_requests_total",
+		Help: "CoAP requests sent to pods by path and result.",
+	}, []string{"path", "result"})
+	coapRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "eightsleep_coap_request_duration_seconds",
+		Help:    "Time from sending a CoAP request to the pod answering, by path.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"path"})
+	coapRequestTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eightsleep_coap_request_timeouts_total",
+		Help: "CoAP requests the pod never answered, by path.",
+	}, []string{"path"})
+	keepAlivesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eightsleep_keepalives_total",
+		Help: "Keepalive pings received from each pod.",
+	}, []string{"device_id"})
+	frankenCommandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eightsleep_franken_commands_total",
+		Help: "Commands received on the FrankenSocket by name, opcodes we don't know are counted as unknown.",
+	}, []string{"command"})
+	heatLevelGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eightsleep_heat_level",
+		Help: "Current heat level of each side (-100 to 100).",
+	}, []string{"device_id", "side"})
+	targetHeatLevelGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eightsleep_target_heat_level",
+		Help: "Target heat level of each side (-100 to 100).",
+	}, []string{"device_id", "side"})
+	heatTimeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eightsleep_heat_time_seconds",
+		Help: "Seconds left before each side turns off.",
+	}, []string{"device_id", "side"})
+	waterLevelGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eightsleep_water_level_ok",
+		Help: "Whether the water tank is full enough (1) or low (0).",
+	}, []string{"device_id"})
+	primingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eightsleep_priming",
+		Help: "Whether the pod is priming.",
+	}, []string{"device_id"})
+)
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// requestPath is the metrics label for a request, e.g. "v/heatLevelL" or "f/prime".  Queries are left out so
+// the values written don't end up as labels.
+func requestPath(msg *message.Message) string {
+	var parts []string
+	for _, option := range msg.Options {
+		if option.ID == message.URIPath {
+			parts = append(parts, string(option.Value))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func recordStatusMetrics(deviceId string, status PodStatus) {
+	sides := map[string]BedStatus{"left": status.LeftBed, "right": status.RightBed}
+	for side, bed := range sides {
+		heatLevelGauge.WithLabelValues(deviceId, side).Set(float64(bed.HeatLevel))
+		targetHeatLevelGauge.WithLabelValues(deviceId, side).Set(float64(bed.TargetHeatLevel))
+		heatTimeGauge.WithLabelValues(deviceId, side).Set(float64(bed.HeatTime))
+	}
+	waterLevelGauge.WithLabelValues(deviceId).Set(boolFloat(status.WaterLevel))
+	primingGauge.WithLabelValues(deviceId).Set(boolFloat(status.Priming))
+}
+
+// forgetStatusMetrics drops the status of a pod that went away so stale levels aren't reported.
+func forgetStatusMetrics(deviceId string) {
+	for _, side := range []string{"left", "right"} {
+		heatLevelGauge.DeleteLabelValues(deviceId, side)
+		targetHeatLevelGauge.DeleteLabelValues(deviceId, side)
+		heatTimeGauge.DeleteLabelValues(deviceId, side)
+	}
+	waterLevelGauge.DeleteLabelValues(deviceId)
+	primingGauge.DeleteLabelValues(deviceId)
+}
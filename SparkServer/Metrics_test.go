@@ -0,0 +1,111 @@
+package SparkServer
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRequestPath(t *testing.T) {
+	msg := message.Message{
+		Options: message.Options{
+			{ID: message.URIPath, Value: []byte("f")},
+			{ID: message.URIPath, Value: []byte("leftLevel")},
+			{ID: message.URIQuery, Value: []byte("-20")},
+		},
+	}
+	if got := requestPath(&msg); got != "f/leftLevel" {
+		t.Errorf("got %q, want the path without the value", got)
+	}
+}
+
+func TestStatusMetrics(t *testing.T) {
+	deviceId := "metrics-test"
+	before := testutil.CollectAndCount(heatLevelGauge)
+	status := PodStatus{WaterLevel: true, LeftBed: BedStatus{HeatLevel: -30, TargetHeatLevel: -40, HeatTime: 600}}
+	recordStatusMetrics(deviceId, status)
+
+	if got := testutil.ToFloat64(heatLevelGauge.WithLabelValues(deviceId, "left")); got != -30 {
+		t.Errorf("heat level %v, want -30", got)
+	}
+	if got := testutil.ToFloat64(targetHeatLevelGauge.WithLabelValues(deviceId, "left")); got != -40 {
+		t.Errorf("target heat level %v, want -40", got)
+	}
+	if got := testutil.ToFloat64(heatTimeGauge.WithLabelValues(deviceId, "left")); got != 600 {
+		t.Errorf("heat time %v, want 600", got)
+	}
+	if got := testutil.ToFloat64(waterLevelGauge.WithLabelValues(deviceId)); got != 1 {
+		t.Errorf("water level %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(heatLevelGauge); got != before+2 {
+		t.Errorf("%d heat level series, want both sides added to %d", got, before)
+	}
+
+	forgetStatusMetrics(deviceId)
+	if got := testutil.CollectAndCount(heatLevelGauge); got != before {
+		t.Errorf("%d heat level series after forgetting the pod, want %d", got, before)
+	}
+}
+
+func TestFrankenCommandMetricOnlyHasKnownNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "franken.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := NewPodConnection(nil, nil, path)
+	finished := make(chan struct{})
+	go func() {
+		c.processUnixSocket()
+		close(finished)
+	}()
+	defer func() {
+		close(c.done)
+		<-finished
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	unknown := frankenCommandsTotal.WithLabelValues("unknown")
+	before := testutil.ToFloat64(unknown)
+	_, err = conn.Write([]byte("9999\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); testutil.ToFloat64(unknown) == before; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("unknown opcode wasn't counted")
+		}
+	}
+
+	known := map[string]bool{"unknown": true}
+	for _, name := range frankenCommandNames {
+		known[name] = true
+	}
+	metrics := make(chan prometheus.Metric, 100)
+	frankenCommandsTotal.Collect(metrics)
+	close(metrics)
+	for metric := range metrics {
+		var written dto.Metric
+		err := metric.Write(&written)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range written.GetLabel() {
+			if label.GetName() != "command" || !known[label.GetValue()] {
+				t.Errorf("label %s=%q isn't a known command name", label.GetName(), label.GetValue())
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package SparkServer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// readJSONFile loads v from path.  A missing file is not an error and leaves v untouched.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile writes v to a temporary file and renames it over path, so a crash never leaves half a file behind.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// validDeviceId reports whether id looks like a pod's device id, the 12 byte stm32 unique id in hex.  Ids from the
+// api name folders under DATA_PATH, so anything else is refused.
+func validDeviceId(id string) bool {
+	if len(id) != hex.EncodedLen(12) {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// deviceDataPath returns where per-pod state is kept, or "" if nothing should be persisted.
+func deviceDataPath(dataPath string, deviceId string, name string) string {
+	if dataPath == "" {
+		return ""
+	}
+	return filepath.Join(dataPath, deviceId, name)
+}
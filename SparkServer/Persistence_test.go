@@ -0,0 +1,35 @@
+package SparkServer
+
+import (
+	"testing"
+)
+
+func TestValidDeviceId(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"00112233445566778899aabb", true},
+		{"", false},
+		{"..", false},
+		{"../../../../etc/cron.d/x", false},
+		{"00112233445566778899aab/", false},
+		{"00112233445566778899aabbcc", false},
+	}
+	for _, test := range tests {
+		if got := validDeviceId(test.id); got != test.want {
+			t.Errorf("validDeviceId(%q) = %t, want %t", test.id, got, test.want)
+		}
+	}
+}
+
+func TestServerRefusesInvalidDeviceIds(t *testing.T) {
+	s := &Server{dataPath: t.TempDir(), calibrations: make(map[string]*CalibrationStore)}
+	_, err := s.Calibration("..")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(s.calibrations) != 0 {
+		t.Error("an invalid device id was remembered")
+	}
+}
@@ -0,0 +1,186 @@
+package SparkServer
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+/*
+free-sleep is written for the pod3, and hands us hex encoded cbor payloads in the pod3 format.
+The Pod 2 firmware accepts the same general shape, but rejects some values (e.g. the "rise" alarm pattern)
+and has no use for others.  Rather than patching each command by hand, every payload passes through a
+PayloadTranslation that describes, field by field, what the Pod 2 will accept.
+*/
+
+// ValueRange is an inclusive range that numeric fields get clamped into.
+type ValueRange struct {
+	Min int64
+	Max int64
+}
+
+// FieldRule describes how a single pod3 field is carried over to the Pod 2.
+type FieldRule struct {
+	Drop     bool              // remove the field entirely
+	Rename   string            // pod 2 key, if different from the pod3 one
+	Values   map[string]string // string substitutions, e.g. "rise" -> "single"
+	Allowed  []string          // string values the pod 2 accepts, anything else becomes Fallback
+	Fallback string
+	Range    *ValueRange // numeric clamp
+}
+
+// PayloadTranslation is the set of rules for one type of payload.
+type PayloadTranslation struct {
+	Name        string
+	Fields      map[string]FieldRule
+	DropUnknown bool // drop fields that have no rule
+}
+
+// TranslationChange records a single modification made to a payload.
+type TranslationChange struct {
+	Field   string      `json:"field"`
+	From    interface{} `json:"from"`
+	To      interface{} `json:"to"`
+	Dropped bool        `json:"dropped"`
+}
+
+var Pod3AlarmTranslation = PayloadTranslation{
+	Name: "alarm",
+	Fields: map[string]FieldRule{
+		"pl": {Range: &ValueRange{Min: 0, Max: 100}},
+		"du": {Range: &ValueRange{Min: 0, Max: 600}},
+		"tt": {},
+		// pod 2 has double or single, other versions have double/rise
+		"pi": {Values: map[string]string{"rise": "single"}, Allowed: []string{"double", "single"}, Fallback: "double"},
+	},
+	DropUnknown: true,
+}
+
+var Pod3SettingsTranslation = PayloadTranslation{
+	Name: "settings",
+	Fields: map[string]FieldRule{
+		"v":  {},
+		"gl": {},
+		"gr": {},
+		// passed through as is, forwarding free-sleep's settings unchanged is how brightness has always worked
+		"lb": {},
+	},
+	DropUnknown: false,
+}
+
+// Translate decodes a cbor payload, applies the rules and re-encodes it.  Fields keep their order, and those the
+// rules leave alone are passed through byte for byte.
+func (t PayloadTranslation) Translate(payload []byte) ([]byte, []TranslationChange, error) {
+	fields, err := decodeCborMap(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding %s payload: %w", t.Name, err)
+	}
+
+	output := make([]cborPair, 0, len(fields))
+	var changes []TranslationChange
+	for _, field := range fields {
+		value, err := field.decodeValue()
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding %s payload: %w", t.Name, err)
+		}
+		rule, ok := t.Fields[field.name]
+		if (!ok && t.DropUnknown) || rule.Drop {
+			changes = append(changes, TranslationChange{Field: field.name, From: value, Dropped: true})
+			continue
+		}
+
+		newValue, changed := rule.apply(value)
+		newKey := field.name
+		if rule.Rename != "" {
+			newKey = rule.Rename
+		}
+		if newKey == field.name && !changed {
+			output = append(output, field)
+			continue
+		}
+		changes = append(changes, TranslationChange{Field: field.name, From: value, To: newValue})
+		newField, err := newCborPair(newKey, newValue)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encoding %s payload: %w", t.Name, err)
+		}
+		output = append(output, newField)
+	}
+	return encodeCborMap(output), changes, nil
+}
+
+// TranslateHex is Translate for the hex strings used on the FrankenSocket and by the pod.
+func (t PayloadTranslation) TranslateHex(input string) (string, []TranslationChange, error) {
+	data, err := hex.DecodeString(input)
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding %s hex: %w", t.Name, err)
+	}
+	output, changes, err := t.Translate(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(output), changes, nil
+}
+
+func (r FieldRule) apply(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		out := v
+		if replacement, ok := r.Values[out]; ok {
+			out = replacement
+		}
+		if len(r.Allowed) > 0 && !containsString(r.Allowed, out) {
+			out = r.Fallback
+		}
+		return out, out != v
+	case uint64:
+		if r.Range == nil {
+			return v, false
+		}
+		if v > uint64(r.Range.Max) {
+			return uint64(r.Range.Max), true
+		}
+		if r.Range.Min > 0 && v < uint64(r.Range.Min) {
+			return uint64(r.Range.Min), true
+		}
+		return v, false
+	case int64:
+		if r.Range == nil {
+			return v, false
+		}
+		if v < r.Range.Min {
+			return r.Range.Min, true
+		}
+		if v > r.Range.Max {
+			return r.Range.Max, true
+		}
+		return v, false
+	default:
+		return value, false
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// translatePayload runs a translation and logs everything that was changed on the way to the pod.
+func (c *PodConnection) translatePayload(t PayloadTranslation, input string) (string, error) {
+	output, changes, err := t.TranslateHex(input)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		if change.Dropped {
+			c.logger.Info("Dropped field unsupported by pod 2", zap.String("payload", t.Name), zap.String("field", change.Field), zap.Any("value", change.From))
+		} else {
+			c.logger.Info("Translated field for pod 2", zap.String("payload", t.Name), zap.String("field", change.Field), zap.Any("from", change.From), zap.Any("to", change.To))
+		}
+	}
+	return output, nil
+}
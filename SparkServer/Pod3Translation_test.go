@@ -0,0 +1,93 @@
+package SparkServer
+
+import (
+	"testing"
+)
+
+// The payloads are hand encoded in the pod3 alarm and settings layouts.  Replace them with ones captured off the
+// FrankenSocket as they turn up, the expectations should hold byte for byte.
+var translationTests = []struct {
+	name        string
+	translation PayloadTranslation
+	input       string
+	output      string
+	changed     []string
+}{
+	{
+		name:        "alarm the pod 2 accepts is passed through",
+		translation: Pod3AlarmTranslation,
+		// {"pl": 50, "du": 180, "pi": "double", "tt": 1700000000}
+		input:  "a4" + "62706c1832" + "62647518b4" + "627069" + "66646f75626c65" + "6274741a6553f100",
+		output: "a4" + "62706c1832" + "62647518b4" + "627069" + "66646f75626c65" + "6274741a6553f100",
+	},
+	{
+		name:        "rise pattern becomes single, in place",
+		translation: Pod3AlarmTranslation,
+		// {"pl": 50, "du": 180, "pi": "rise", "tt": 1700000000}
+		input: "a4" + "62706c1832" + "62647518b4" + "627069" + "6472697365" + "6274741a6553f100",
+		// {"pl": 50, "du": 180, "pi": "single", "tt": 1700000000}
+		output:  "a4" + "62706c1832" + "62647518b4" + "627069" + "6673696e676c65" + "6274741a6553f100",
+		changed: []string{"pi"},
+	},
+	{
+		name:        "intensity is clamped and unknown fields dropped",
+		translation: Pod3AlarmTranslation,
+		// {"pl": 150, "xx": 1, "du": 180, "pi": "double", "tt": 1700000000}
+		input: "a5" + "62706c1896" + "62787801" + "62647518b4" + "627069" + "66646f75626c65" + "6274741a6553f100",
+		// {"pl": 100, "du": 180, "pi": "double", "tt": 1700000000}
+		output:  "a4" + "62706c1864" + "62647518b4" + "627069" + "66646f75626c65" + "6274741a6553f100",
+		changed: []string{"pl", "xx"},
+	},
+	{
+		name:        "indefinite length map comes out definite",
+		translation: Pod3AlarmTranslation,
+		// {_ "pl": 50, "tt": 1700000000}
+		input: "bf" + "62706c1832" + "6274741a6553f100" + "ff",
+		// {"pl": 50, "tt": 1700000000}
+		output: "a2" + "62706c1832" + "6274741a6553f100",
+	},
+	{
+		name:        "unknown settings are kept where they were",
+		translation: Pod3SettingsTranslation,
+		// {"v": 1, "zz": h'0102', "gl": 400, "gr": 400, "lb": 50}
+		input:  "a5" + "617601" + "627a7a420102" + "62676c190190" + "626772190190" + "626c621832",
+		output: "a5" + "617601" + "627a7a420102" + "62676c190190" + "626772190190" + "626c621832",
+	},
+	{
+		name:        "brightness isn't clamped",
+		translation: Pod3SettingsTranslation,
+		// {"v": 1, "gl": 400, "gr": 400, "lb": 200}
+		input:  "a4" + "617601" + "62676c190190" + "626772190190" + "626c6218c8",
+		output: "a4" + "617601" + "62676c190190" + "626772190190" + "626c6218c8",
+	},
+}
+
+func TestTranslateHex(t *testing.T) {
+	for _, test := range translationTests {
+		t.Run(test.name, func(t *testing.T) {
+			output, changes, err := test.translation.TranslateHex(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.output {
+				t.Errorf("got %s, want %s", output, test.output)
+			}
+			if len(changes) != len(test.changed) {
+				t.Fatalf("got %d changes, want %v: %+v", len(changes), test.changed, changes)
+			}
+			for i, change := range changes {
+				if change.Field != test.changed[i] {
+					t.Errorf("change %d is to %s, want %s", i, change.Field, test.changed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTranslateRejectsNonMap(t *testing.T) {
+	// an array, not a map
+	_, _, err := Pod3AlarmTranslation.TranslateHex("820102")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/cipher"
 	"crypto/rsa"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"net"
 	"sync"
@@ -25,29 +26,88 @@ type PodConnection struct {
 	incomingIv       [16]byte
 	outgoingIv       [16]byte
 	deviceId         [12]byte
-	messageId        uint8 // outgoing mid can only be 0-255, loop back to 0 after that
-	currentRequest   *PodRequest
+	messageId        uint8       // outgoing mid can only be 0-255, loop back to 0 after that
+	currentRequest   *PodRequest // the request waiting on an ack, guarded by requestMutex
+	requestMutex     sync.Mutex
 	RequestPipe      chan *PodRequest
 	sendMutex        sync.Mutex
+	settingsMutex    sync.Mutex
+	alarms           map[BedSide]AlarmParams // last alarm written per side
+	armedAlarms      map[BedSide]AlarmParams // last armed alarm per side, kept through a clear for RearmAlarm
+	alarmMutex       sync.Mutex
+	programSteps     map[BedSide]*ProgramStepStatus // active temperature program step per side
+	programMutex     sync.Mutex
+	ramps            map[BedSide]*ramp
+	calibration      *CalibrationStore
+	safety           *SafetyGuard
+	primer           *PrimeScheduler
+	events           *EventBus
+	lastStatus       *PodStatus
+	lastStatusAt     time.Time
+	statusRefresh    chan struct{} // see refreshStatus
+	statusMutex      sync.Mutex
+	heatRuns         map[BedSide]heatRun // see SetValueFrom
+	heatMutex        sync.Mutex
+	rampMutex        sync.Mutex
+	rampWriteMutexes map[BedSide]*sync.Mutex // held while a ramp writes a side's level, see setRampLevel
 	socketPath       string
+	dimmingSchedule  *DimmingSchedule
+	done             chan struct{} // closed once the pod disconnects
+	readyOnce        sync.Once     // the per-connection loops are started on the first hello only
+	onReady          func(c *PodConnection)
 	logger           *zap.Logger
 }
 
 func NewPodConnection(conn *net.Conn, serverPublicKey *rsa.PrivateKey, socketPath string) *PodConnection {
 	logger, _ := zap.NewProduction()
 	return &PodConnection{conn: conn, serverPrivateKey: serverPublicKey, messageId: 0,
-		RequestPipe: make(chan *PodRequest, 100),
-		socketPath:  socketPath,
-		logger:      logger,
+		RequestPipe:   make(chan *PodRequest, 100),
+		socketPath:    socketPath,
+		done:          make(chan struct{}),
+		statusRefresh: make(chan struct{}, 1),
+		alarms:        make(map[BedSide]AlarmParams),
+		armedAlarms:   make(map[BedSide]AlarmParams),
+		programSteps:  make(map[BedSide]*ProgramStepStatus),
+		ramps:         make(map[BedSide]*ramp),
+		heatRuns:      make(map[BedSide]heatRun),
+		logger:        logger,
+		rampWriteMutexes: map[BedSide]*sync.Mutex{
+			BedSideLeft:  {},
+			BedSideRight: {},
+		},
 	}
 }
 
+// start runs the ready callback and the loops that live as long as the connection.
+func (c *PodConnection) start() {
+	if c.onReady != nil {
+		c.onReady(c)
+	}
+	go c.connectToUnixSocket()
+	if c.dimmingSchedule != nil {
+		go c.runDimmingSchedule(c.dimmingSchedule)
+	}
+}
+
+// DeviceId returns the pod's stm32 unique id as sent in the handshake, in hex.
+func (c *PodConnection) DeviceId() string {
+	return hex.EncodeToString(c.deviceId[:])
+}
+
+// Done is closed once the pod disconnects.
+func (c *PodConnection) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *PodConnection) HandleConnection() {
+	defer close(c.done)
 	err := c.performHandshake()
 	if err != nil {
+		handshakesTotal.WithLabelValues("failure").Inc()
 		c.logger.Error("Error performing handshake", zap.Error(err))
 		return
 	}
+	handshakesTotal.WithLabelValues("success").Inc()
 
 	c.logger.Info("Handshake successful, Ready for further communication")
 	go c.podRequestHandler()
@@ -82,6 +142,7 @@ func (c *PodConnection) HandleConnection() {
 				url = "/"
 			}
 			if url == "/" && coapmsg.Type() == message.Confirmable {
+				keepAlivesTotal.WithLabelValues(c.DeviceId()).Inc()
 				err := c.handleKeepAlive(coapmsg)
 				if err != nil {
 					c.logger.Error("Error handling ping like", zap.Error(err))
@@ -90,20 +151,19 @@ func (c *PodConnection) HandleConnection() {
 				continue
 			}
 			if coapmsg.Type() == message.Acknowledgement {
-				if c.currentRequest != nil && coapmsg.MessageID() == c.currentRequest.message.MessageID {
-					body, err := coapmsg.ReadBody()
-					if err != nil {
-						c.logger.Error("Error reading body of pod Response", zap.Error(err))
-						continue
-					}
-					cr := c.currentRequest
-					c.currentRequest = nil
-					cr.SetResponse(body)
+				body, err := coapmsg.ReadBody()
+				if err != nil {
+					c.logger.Error("Error reading body of pod Response", zap.Error(err))
 					continue
-				} else {
-					c.logger.Info("Received acknowledgement for unknown request, ignoring")
+				}
+				cr := c.takeCurrentRequest(coapmsg.MessageID())
+				if cr == nil {
+					// most likely the late ack for a request that already timed out
+					c.logger.Info("Received acknowledgement for unknown request, ignoring", zap.Int32("message_id", coapmsg.MessageID()))
 					continue
 				}
+				cr.SetResponse(body)
+				continue
 			}
 
 			switch url {
@@ -114,7 +174,7 @@ func (c *PodConnection) HandleConnection() {
 					c.logger.Error("Error when sending hello Response", zap.Error(err))
 					return
 				}
-				go c.connectToUnixSocket()
+				c.readyOnce.Do(c.start)
 			case "/E/spark/device/claim/code":
 				// noop
 			case "/E/spark/hardware/max_binary":
@@ -285,16 +345,84 @@ func (c *PodConnection) handleTimestamp(incoming *pool.Message) error {
 func (c *PodConnection) podRequestHandler() {
 	for {
 		select {
+		case <-c.done:
+			c.failPendingRequests()
+			return
 		case req := <-c.RequestPipe:
 			//c.logger.Debug("Received pod request")
-			c.currentRequest = req
-			err := c.sendMessage(req.message)
+			path := requestPath(req.message)
+			sent := time.Now()
+			err := c.sendRequest(req)
 			if err != nil {
 				c.logger.Error("Error sending pod request Response", zap.Error(err))
+				coapRequestsTotal.WithLabelValues(path, "error").Inc()
+				req.SetError(err)
 				continue
 			}
-			<-req.Ready // blocks until Response is Ready
-			//c.logger.Debug("Pod request Response Ready")
+			select {
+			case <-req.Ready: // blocks until Response is Ready
+				//c.logger.Debug("Pod request Response Ready")
+				coapRequestsTotal.WithLabelValues(path, "ok").Inc()
+				coapRequestDuration.WithLabelValues(path).Observe(time.Since(sent).Seconds())
+			case <-time.After(podRequestTimeout):
+				c.logger.Warn("Pod request timed out", zap.String("path", path))
+				coapRequestsTotal.WithLabelValues(path, "timeout").Inc()
+				coapRequestTimeoutsTotal.WithLabelValues(path).Inc()
+				c.clearCurrentRequest(req)
+				req.SetError(ErrPodRequestTimeout)
+			case <-c.done:
+				c.clearCurrentRequest(req)
+				req.SetError(ErrPodDisconnected)
+				c.failPendingRequests()
+				return
+			}
+		}
+	}
+}
+
+// sendRequest sends a request and makes it the one waiting on an ack.  The lock is held across the send, as that's
+// when the message id is given out, so an ack can't be matched against the request before then.
+func (c *PodConnection) sendRequest(req *PodRequest) error {
+	c.requestMutex.Lock()
+	defer c.requestMutex.Unlock()
+	err := c.sendMessage(req.message)
+	if err != nil {
+		return err
+	}
+	c.currentRequest = req
+	return nil
+}
+
+// takeCurrentRequest returns the request waiting on the ack with messageId and stops it waiting, nil if there's no
+// such request.
+func (c *PodConnection) takeCurrentRequest(messageId int32) *PodRequest {
+	c.requestMutex.Lock()
+	defer c.requestMutex.Unlock()
+	req := c.currentRequest
+	if req == nil || req.message.MessageID != messageId {
+		return nil
+	}
+	c.currentRequest = nil
+	return req
+}
+
+// clearCurrentRequest stops req waiting on an ack, if it still is.
+func (c *PodConnection) clearCurrentRequest(req *PodRequest) {
+	c.requestMutex.Lock()
+	defer c.requestMutex.Unlock()
+	if c.currentRequest == req {
+		c.currentRequest = nil
+	}
+}
+
+// failPendingRequests releases anyone still waiting on a request after the pod went away.
+func (c *PodConnection) failPendingRequests() {
+	for {
+		select {
+		case req := <-c.RequestPipe:
+			req.SetError(ErrPodDisconnected)
+		default:
+			return
 		}
 	}
 }
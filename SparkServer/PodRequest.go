@@ -1,11 +1,26 @@
 package SparkServer
 
-import "github.com/plgd-dev/go-coap/v3/message"
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+)
+
+const podRequestTimeout = 10 * time.Second
+
+var (
+	ErrPodRequestTimeout = errors.New("pod request timed out")
+	ErrPodDisconnected   = errors.New("pod disconnected")
+)
 
 type PodRequest struct {
 	message  *message.Message
 	Response []byte
+	Err      error
 	Ready    chan bool
+	once     sync.Once
 }
 
 func NewPodRequest(msg *message.Message) *PodRequest {
@@ -16,6 +31,41 @@ func NewPodRequest(msg *message.Message) *PodRequest {
 }
 
 func (pr *PodRequest) SetResponse(resp []byte) {
-	pr.Response = resp
-	close(pr.Ready)
+	pr.once.Do(func() {
+		pr.Response = resp
+		close(pr.Ready)
+	})
+}
+
+// SetError completes the request without a response. Whichever of SetResponse/SetError comes first wins.
+func (pr *PodRequest) SetError(err error) {
+	pr.once.Do(func() {
+		pr.Err = err
+		close(pr.Ready)
+	})
+}
+
+// doRequest queues a request for the pod and waits for its response.
+func (c *PodConnection) doRequest(msg *message.Message) ([]byte, error) {
+	podReq := NewPodRequest(msg)
+	// with done closed select could still pick the buffered send, which nothing would then read
+	select {
+	case <-c.done:
+		return nil, ErrPodDisconnected
+	default:
+	}
+	select {
+	case c.RequestPipe <- podReq:
+	case <-c.done:
+		return nil, ErrPodDisconnected
+	}
+	select {
+	case <-podReq.Ready:
+		return podReq.Response, podReq.Err
+	case <-c.done:
+		// the handler may be gone without failing the request, if it was queued as the pod disconnected
+		podReq.SetError(ErrPodDisconnected)
+		<-podReq.Ready
+		return podReq.Response, podReq.Err
+	}
 }
@@ -0,0 +1,70 @@
+package SparkServer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+)
+
+func waitForRequest(t *testing.T, result chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("request never returned")
+		return nil
+	}
+}
+
+func TestDoRequestAfterDisconnect(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	close(c.done)
+	for i := 0; i < 200; i++ {
+		result := make(chan error, 1)
+		go func() {
+			_, err := c.doRequest(&message.Message{})
+			result <- err
+		}()
+		err := waitForRequest(t, result)
+		if !errors.Is(err, ErrPodDisconnected) {
+			t.Fatalf("got %v, want %v", err, ErrPodDisconnected)
+		}
+	}
+}
+
+func TestDoRequestQueuedAsPodDisconnects(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.doRequest(&message.Message{})
+		result <- err
+	}()
+	for len(c.RequestPipe) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// no handler is running to fail it
+	close(c.done)
+	err := waitForRequest(t, result)
+	if !errors.Is(err, ErrPodDisconnected) {
+		t.Fatalf("got %v, want %v", err, ErrPodDisconnected)
+	}
+}
+
+func TestLateAckIsDropped(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	req := NewPodRequest(&message.Message{MessageID: 5})
+	c.currentRequest = req
+
+	if c.takeCurrentRequest(4) != nil {
+		t.Error("ack for an earlier message completed the current request")
+	}
+	if c.takeCurrentRequest(5) != req {
+		t.Error("ack for the current request didn't match it")
+	}
+	if c.takeCurrentRequest(5) != nil {
+		t.Error("request was matched twice")
+	}
+}
@@ -0,0 +1,153 @@
+package SparkServer
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// PodSettings is the decoded form of the hex cbor blob the pod reports as "settings" and accepts on "setsettings".
+// What v, gl, gr and lb mean is worked out from how free-sleep uses them, nothing documents them, which is why
+// Encode leaves everything it wasn't asked to change alone.
+type PodSettings struct {
+	Version       int `cbor:"v" json:"version"`
+	GainLeft      int `cbor:"gl" json:"gain_left"`
+	GainRight     int `cbor:"gr" json:"gain_right"`
+	LedBrightness int `cbor:"lb" json:"led_brightness"`
+
+	// the blob as the pod sent it, so writing the settings back only changes the fields that were set
+	fields   []cborPair
+	original map[string]int
+}
+
+var knownSettingsFields = []string{"v", "gl", "gr", "lb"}
+
+var settingsFieldNames = map[string]string{
+	"v":  "version",
+	"gl": "left gain",
+	"gr": "right gain",
+	"lb": "led brightness",
+}
+
+func DecodePodSettings(input string) (PodSettings, error) {
+	var settings PodSettings
+	data, err := hex.DecodeString(input)
+	if err != nil {
+		return settings, fmt.Errorf("decoding settings hex: %w", err)
+	}
+
+	err = cbor.Unmarshal(data, &settings)
+	if err != nil {
+		return settings, fmt.Errorf("decoding settings: %w", err)
+	}
+	settings.fields, err = decodeCborMap(data)
+	if err != nil {
+		return settings, fmt.Errorf("decoding settings: %w", err)
+	}
+	settings.original = settings.values()
+	return settings, nil
+}
+
+func (s PodSettings) values() map[string]int {
+	return map[string]int{
+		"v":  s.Version,
+		"gl": s.GainLeft,
+		"gr": s.GainRight,
+		"lb": s.LedBrightness,
+	}
+}
+
+// Encode returns the settings as the hex string expected by "setsettings".  Fields keep their order and anything
+// not changed since decoding, including fields we don't understand, is written back as the pod sent it.  Known
+// fields the pod's blob lacked are only added if they were set.
+func (s PodSettings) Encode() (string, error) {
+	values := s.values()
+	output := make([]cborPair, 0, len(s.fields)+len(knownSettingsFields))
+	present := make(map[string]bool, len(s.fields))
+	for _, field := range s.fields {
+		present[field.name] = true
+		value, known := values[field.name]
+		if !known || value == s.original[field.name] {
+			output = append(output, field)
+			continue
+		}
+		changed, err := newCborPair(field.name, value)
+		if err != nil {
+			return "", fmt.Errorf("encoding settings: %w", err)
+		}
+		output = append(output, changed)
+	}
+	for _, key := range knownSettingsFields {
+		if present[key] || values[key] == s.original[key] {
+			continue
+		}
+		added, err := newCborPair(key, values[key])
+		if err != nil {
+			return "", fmt.Errorf("encoding settings: %w", err)
+		}
+		output = append(output, added)
+	}
+	return hex.EncodeToString(encodeCborMap(output)), nil
+}
+
+// Validate checks the fields changed since decoding.  Nothing says how far the pod's scales go, so the only limit is
+// that they can't be negative, and whatever the pod itself reported is left to it.
+func (s PodSettings) Validate() error {
+	values := s.values()
+	for _, key := range knownSettingsFields {
+		value := values[key]
+		if value != s.original[key] && value < 0 {
+			return Invalidf("%s %d can't be negative", settingsFieldNames[key], value)
+		}
+	}
+	return nil
+}
+
+// Gain returns the gain for one side of the bed.
+func (s PodSettings) Gain(side BedSide) int {
+	if side == BedSideRight {
+		return s.GainRight
+	}
+	return s.GainLeft
+}
+
+// SetGain sets the gain for one side of the bed.
+func (s *PodSettings) SetGain(side BedSide, gain int) {
+	if side == BedSideRight {
+		s.GainRight = gain
+	} else {
+		s.GainLeft = gain
+	}
+}
+
+// GetSettings reads the current settings from the pod.
+func (c *PodConnection) GetSettings() (PodSettings, error) {
+	settings, err := c.getVariable("settings")
+	if err != nil {
+		return PodSettings{}, err
+	}
+	return DecodePodSettings(unwrapQuotes(string(settings[:])))
+}
+
+// UpdateSettings reads the current settings, applies modify and writes the result back, so a single setting
+// can be changed without clobbering the others.
+func (c *PodConnection) UpdateSettings(modify func(settings *PodSettings)) error {
+	c.settingsMutex.Lock()
+	defer c.settingsMutex.Unlock()
+
+	settings, err := c.GetSettings()
+	if err != nil {
+		return err
+	}
+	modify(&settings)
+	err = settings.Validate()
+	if err != nil {
+		return err
+	}
+	encoded, err := settings.Encode()
+	if err != nil {
+		return err
+	}
+	return c.SetValue("setsettings", encoded)
+}
@@ -0,0 +1,90 @@
+package SparkServer
+
+import (
+	"errors"
+	"testing"
+)
+
+// {"v": 1, "zz": h'0102', "gl": 400, "gr": 400, "lb": 200}, zz standing in for a field we don't know about
+const settingsBlob = "a5" + "617601" + "627a7a420102" + "62676c190190" + "626772190190" + "626c6218c8"
+
+func TestPodSettingsRoundTrip(t *testing.T) {
+	settings, err := DecodePodSettings(settingsBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Version != 1 || settings.GainLeft != 400 || settings.GainRight != 400 || settings.LedBrightness != 200 {
+		t.Fatalf("decoded %+v", settings)
+	}
+	encoded, err := settings.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != settingsBlob {
+		t.Errorf("got %s, want %s", encoded, settingsBlob)
+	}
+}
+
+func TestPodSettingsChangesOnlyWhatWasSet(t *testing.T) {
+	settings, err := DecodePodSettings(settingsBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.LedBrightness = 50
+	settings.SetGain(BedSideRight, 300)
+	encoded, err := settings.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"v": 1, "zz": h'0102', "gl": 400, "gr": 300, "lb": 50}
+	want := "a5" + "617601" + "627a7a420102" + "62676c190190" + "62677219012c" + "626c621832"
+	if encoded != want {
+		t.Errorf("got %s, want %s", encoded, want)
+	}
+}
+
+func TestPodSettingsMissingFields(t *testing.T) {
+	// {"v": 1, "lb": 200}
+	blob := "a2" + "617601" + "626c6218c8"
+	settings, err := DecodePodSettings(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := settings.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != blob {
+		t.Errorf("unchanged settings grew fields: got %s, want %s", encoded, blob)
+	}
+
+	settings.SetGain(BedSideLeft, 400)
+	encoded, err = settings.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"v": 1, "lb": 200, "gl": 400}
+	want := "a3" + "617601" + "626c6218c8" + "62676c190190"
+	if encoded != want {
+		t.Errorf("got %s, want %s", encoded, want)
+	}
+}
+
+func TestPodSettingsValidatesOnlyWhatChanged(t *testing.T) {
+	// {"v": 1, "gl": -5, "gr": 400, "lb": 200}
+	settings, err := DecodePodSettings("a4" + "617601" + "62676c24" + "626772190190" + "626c6218c8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.SetGain(BedSideRight, 300)
+	if err := settings.Validate(); err != nil {
+		t.Errorf("changing the right gain failed on fields it didn't touch: %v", err)
+	}
+
+	settings.LedBrightness = -1
+	var validationError *ValidationError
+	if err := settings.Validate(); !errors.As(err, &validationError) {
+		t.Errorf("got %v, want a validation error", err)
+	}
+}
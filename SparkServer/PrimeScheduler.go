@@ -0,0 +1,268 @@
+package SparkServer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Priming runs the pumps to fill the lines with water.  It can be started by hand (free-sleep, the api) or once a day
+at a set time.  A scheduled prime is skipped if either side is heating or running a temperature program, since the
+pod 2 doesn't report bed presence that is the best sign someone is in bed.
+
+Every prime is followed through the pod's "priming" variable, from the pod starting until it reports it's done, and
+the outcome is kept in a per pod history.
+*/
+
+const (
+	primeStartTimeout   = 2 * time.Minute
+	primeMaxDuration    = 30 * time.Minute
+	primePollInterval   = 10 * time.Second
+	primeHistoryEntries = 100
+	// the daily prime only starts this soon after its time, so a restart or reconnect later on doesn't prime under
+	// someone who has gone to bed
+	primeScheduleWindow = 15 * time.Minute
+)
+
+const (
+	PrimeCompleted    = "completed"
+	PrimeNeverStarted = "never_started"
+	PrimeStuck        = "stuck"
+	PrimeFailed       = "failed"
+	PrimeSkipped      = "skipped"
+)
+
+var ErrPrimeInProgress = errors.New("a prime is already in progress")
+
+type PrimeRecord struct {
+	Source          CommandSource `json:"source"`
+	Scheduled       bool          `json:"scheduled"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	DurationSeconds int           `json:"duration_seconds"`
+	Outcome         string        `json:"outcome"`
+	Reason          string        `json:"reason,omitempty"`
+}
+
+// PrimeScheduler tracks the primes of one pod, and runs the daily prime if a time is set.
+type PrimeScheduler struct {
+	path      string
+	dailyTime string // HH:MM, empty to only prime by hand
+	history   []PrimeRecord
+	active    *PrimeRecord
+	mutex     sync.Mutex
+	logger    *zap.Logger
+}
+
+func NewPrimeScheduler(path string, dailyTime string, logger *zap.Logger) (*PrimeScheduler, error) {
+	if dailyTime != "" {
+		_, err := parseTimeOfDay(dailyTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &PrimeScheduler{
+		path:      path,
+		dailyTime: dailyTime,
+		logger:    logger,
+	}
+	if path != "" {
+		err := readJSONFile(path, &s.history)
+		if err != nil {
+			return nil, fmt.Errorf("loading prime history: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// History returns past primes, oldest first.
+func (s *PrimeScheduler) History() []PrimeRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]PrimeRecord(nil), s.history...)
+}
+
+// Active returns the prime in progress, nil if none.
+func (s *PrimeScheduler) Active() *PrimeRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	record := *s.active
+	return &record
+}
+
+func (s *PrimeScheduler) record(record PrimeRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.history = append(s.history, record)
+	if len(s.history) > primeHistoryEntries {
+		s.history = s.history[len(s.history)-primeHistoryEntries:]
+	}
+	if s.path == "" {
+		return
+	}
+	err := writeJSONFile(s.path, s.history)
+	if err != nil {
+		s.logger.Error("Error saving prime history", zap.Error(err))
+	}
+}
+
+// Start asks the pod to prime and follows it in the background.
+func (s *PrimeScheduler) Start(c *PodConnection, source CommandSource, scheduled bool) error {
+	s.mutex.Lock()
+	if s.active != nil {
+		s.mutex.Unlock()
+		return ErrPrimeInProgress
+	}
+	record := &PrimeRecord{Source: source, Scheduled: scheduled, StartedAt: time.Now()}
+	s.active = record
+	s.mutex.Unlock()
+
+	err := c.SetValueFrom(source, "prime", "true")
+	if err != nil {
+		s.finish(record, PrimeFailed, err.Error())
+		return err
+	}
+	s.logger.Info("Prime requested", zap.String("source", string(source)), zap.Bool("scheduled", scheduled))
+	go s.follow(c, record)
+	return nil
+}
+
+func (s *PrimeScheduler) finish(record *PrimeRecord, outcome string, reason string) {
+	// Active copies the record under the lock, so it's only changed under it
+	s.mutex.Lock()
+	record.FinishedAt = time.Now()
+	record.DurationSeconds = int(record.FinishedAt.Sub(record.StartedAt).Seconds())
+	record.Outcome = outcome
+	record.Reason = reason
+	finished := *record
+	if s.active == record {
+		s.active = nil
+	}
+	s.mutex.Unlock()
+	s.record(finished)
+	s.logger.Info("Prime finished", zap.String("outcome", outcome), zap.String("reason", reason), zap.Int("duration_seconds", finished.DurationSeconds))
+}
+
+// follow polls the priming flag until the pod has started and finished priming.
+func (s *PrimeScheduler) follow(c *PodConnection, record *PrimeRecord) {
+	ticker := time.NewTicker(primePollInterval)
+	defer ticker.Stop()
+
+	started := false
+	for {
+		select {
+		case <-c.done:
+			s.finish(record, PrimeFailed, "pod disconnected")
+			return
+		case now := <-ticker.C:
+			data, err := c.getVariable("priming")
+			if err != nil {
+				s.logger.Warn("Error reading priming flag", zap.Error(err))
+				continue
+			}
+			priming := string(data) == "true"
+			switch {
+			case !started && priming:
+				started = true
+				s.logger.Info("Pod started priming")
+			case !started && now.Sub(record.StartedAt) > primeStartTimeout:
+				s.finish(record, PrimeNeverStarted, "pod never reported priming")
+				return
+			case started && !priming:
+				s.finish(record, PrimeCompleted, "")
+				return
+			case now.Sub(record.StartedAt) > primeMaxDuration:
+				s.finish(record, PrimeStuck, "still priming after "+primeMaxDuration.String())
+				return
+			}
+		}
+	}
+}
+
+// primedToday reports whether a scheduled prime was already attempted on the day of now.
+func (s *PrimeScheduler) primedToday(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	year, month, day := now.Date()
+	for i := len(s.history) - 1; i >= 0; i-- {
+		record := s.history[i]
+		if !record.Scheduled {
+			continue
+		}
+		y, m, d := record.StartedAt.In(now.Location()).Date()
+		return y == year && m == month && d == day
+	}
+	return false
+}
+
+// primeDue reports whether now is within primeScheduleWindow of the daily prime's time.
+func primeDue(now time.Time, due time.Time) bool {
+	return !now.Before(due) && now.Sub(due) < primeScheduleWindow
+}
+
+// Run starts the daily prime at its time each day, until the pod disconnects.  If the pod isn't connected then, or
+// the server isn't running, that day's prime is missed rather than run late.
+func (s *PrimeScheduler) Run(c *PodConnection) {
+	if s.dailyTime == "" {
+		return
+	}
+	timeOfDay, _ := parseTimeOfDay(s.dailyTime)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		due := wallClock(now.Year(), now.Month(), now.Day(), timeOfDay, now.Location())
+		if primeDue(now, due) && !s.primedToday(now) && s.Active() == nil {
+			s.runScheduled(c)
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *PrimeScheduler) runScheduled(c *PodConnection) {
+	skip := func(reason string) {
+		now := time.Now()
+		s.record(PrimeRecord{Source: SourceServer, Scheduled: true, StartedAt: now, FinishedAt: now, Outcome: PrimeSkipped, Reason: reason})
+		s.logger.Info("Skipped scheduled prime", zap.String("reason", reason))
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		s.logger.Error("Error reading status for scheduled prime", zap.Error(err))
+		return
+	}
+	switch {
+	case status.Priming:
+		skip("already priming")
+	case status.LeftBed.HeatTime > 0 || status.RightBed.HeatTime > 0:
+		skip("a side is heating")
+	case status.LeftBed.ProgramStep != nil || status.RightBed.ProgramStep != nil:
+		skip("a side is running a temperature program")
+	default:
+		err := s.Start(c, SourceServer, true)
+		if err != nil {
+			s.logger.Error("Error starting scheduled prime", zap.Error(err))
+		}
+	}
+}
+
+// Prime starts a prime, tracked by the pod's prime scheduler.
+func (c *PodConnection) Prime(source CommandSource) error {
+	if c.primer == nil {
+		return c.SetValueFrom(source, "prime", "true")
+	}
+	return c.primer.Start(c, source, false)
+}
@@ -0,0 +1,56 @@
+package SparkServer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPrimeDue(t *testing.T) {
+	due := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{due.Add(-time.Minute), false},
+		{due, true},
+		{due.Add(primeScheduleWindow - time.Second), true},
+		// a restart at bedtime
+		{due.Add(8 * time.Hour), false},
+	}
+	for _, test := range tests {
+		if got := primeDue(test.now, due); got != test.want {
+			t.Errorf("primeDue(%s) = %t, want %t", test.now.Format(time.Kitchen), got, test.want)
+		}
+	}
+}
+
+func TestPrimeFinishWhileActiveIsRead(t *testing.T) {
+	s, err := NewPrimeScheduler("", "", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &PrimeRecord{Source: SourceServer, StartedAt: time.Now()}
+	s.active = record
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Active()
+		}
+	}()
+	s.finish(record, PrimeCompleted, "")
+	wg.Wait()
+
+	if s.Active() != nil {
+		t.Error("prime still active after finishing")
+	}
+	history := s.History()
+	if len(history) != 1 || history[0].Outcome != PrimeCompleted {
+		t.Errorf("history is %+v", history)
+	}
+}
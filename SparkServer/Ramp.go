@@ -0,0 +1,233 @@
+package SparkServer
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+A ramp moves a side's target level from its current heat level to a goal over a period of time, rather than
+jumping straight there.  The level follows a straight line, checked every Interval, and is only written to the pod
+once it has moved by at least StepSize (the final step always lands on the goal).
+Level changes from free-sleep on the FrankenSocket are taken as a manual override and cancel the ramp.
+*/
+
+const (
+	defaultRampStepSize = 1
+	defaultRampInterval = time.Minute
+)
+
+type RampParams struct {
+	Side     BedSide       `json:"side"`
+	Goal     int           `json:"goal"`
+	Duration time.Duration `json:"duration"`
+	StepSize int           `json:"step_size"` // minimum level change worth sending, default 1
+	Interval time.Duration `json:"interval"`  // how often the level is updated, default one minute
+}
+
+type RampStatus struct {
+	Start     int       `json:"start"`
+	Goal      int       `json:"goal"`
+	Current   int       `json:"current"`
+	StartedAt time.Time `json:"started_at"`
+	EndsAt    time.Time `json:"ends_at"`
+}
+
+type ramp struct {
+	params RampParams
+	status RampStatus
+	cancel chan struct{}
+	once   sync.Once
+}
+
+func (r *ramp) stop() {
+	r.once.Do(func() {
+		close(r.cancel)
+	})
+}
+
+func (p *RampParams) validate() error {
+	if p.Side != BedSideLeft && p.Side != BedSideRight {
+		return Invalidf("invalid side %d", p.Side)
+	}
+	if p.Goal < MinHeatLevel || p.Goal > MaxHeatLevel {
+		return Invalidf("goal %d out of range %d-%d", p.Goal, MinHeatLevel, MaxHeatLevel)
+	}
+	if p.Duration <= 0 {
+		return Invalidf("ramp duration must be positive")
+	}
+	if p.StepSize == 0 {
+		p.StepSize = defaultRampStepSize
+	}
+	if p.Interval == 0 {
+		p.Interval = defaultRampInterval
+	}
+	if p.StepSize < 0 {
+		return Invalidf("ramp step size must be positive")
+	}
+	if p.Interval < time.Second {
+		return Invalidf("ramp interval must be at least a second")
+	}
+	return nil
+}
+
+// StartRamp begins ramping a side to the goal, replacing any ramp already running on that side.
+func (c *PodConnection) StartRamp(params RampParams) (RampStatus, error) {
+	err := params.validate()
+	if err != nil {
+		return RampStatus{}, err
+	}
+
+	variable := "heatLevelL"
+	if params.Side == BedSideRight {
+		variable = "heatLevelR"
+	}
+	data, err := c.getVariable(variable)
+	if err != nil {
+		return RampStatus{}, err
+	}
+	start, err := strconv.Atoi(string(data))
+	if err != nil {
+		return RampStatus{}, fmt.Errorf("parsing current heat level: %w", err)
+	}
+
+	now := time.Now()
+	r := &ramp{
+		params: params,
+		status: RampStatus{
+			Start:     start,
+			Goal:      params.Goal,
+			Current:   start,
+			StartedAt: now,
+			EndsAt:    now.Add(params.Duration),
+		},
+		cancel: make(chan struct{}),
+	}
+
+	c.rampMutex.Lock()
+	existing, replacing := c.ramps[params.Side]
+	if replacing {
+		existing.stop()
+	}
+	c.ramps[params.Side] = r
+	c.rampMutex.Unlock()
+	if replacing {
+		c.waitForRampWrite(params.Side)
+	}
+
+	c.logger.Info("Starting ramp", zap.Int("side", int(params.Side)), zap.Int("start", start), zap.Int("goal", params.Goal), zap.Duration("duration", params.Duration))
+	go c.runRamp(r)
+	return r.status, nil
+}
+
+// CancelRamp stops the ramp on a side, leaving the level where it is.  Returns false if there was no ramp.
+func (c *PodConnection) CancelRamp(side BedSide) bool {
+	c.rampMutex.Lock()
+	r, ok := c.ramps[side]
+	if ok {
+		r.stop()
+		delete(c.ramps, side)
+	}
+	c.rampMutex.Unlock()
+	if ok {
+		c.waitForRampWrite(side)
+	}
+	return ok
+}
+
+// setRampLevel writes the ramp's next level, unless it has been stopped.  The side's write mutex is held from the
+// check until the pod has the level, so a stopped ramp can't land a stale level after whatever replaced it.
+func (c *PodConnection) setRampLevel(r *ramp, level int) (bool, error) {
+	mutex := c.rampWriteMutexes[r.params.Side]
+	mutex.Lock()
+	defer mutex.Unlock()
+	select {
+	case <-r.cancel:
+		return false, nil
+	default:
+	}
+	return true, c.SetLevel(level, r.params.Side)
+}
+
+// waitForRampWrite returns once any ramp write in flight on a side is done.  Ramps stopped before calling it won't
+// write again.  The other side's ramp isn't waited for.
+func (c *PodConnection) waitForRampWrite(side BedSide) {
+	mutex := c.rampWriteMutexes[side]
+	mutex.Lock()
+	mutex.Unlock()
+}
+
+// Ramp returns the ramp running on a side, nil if none.
+func (c *PodConnection) Ramp(side BedSide) *RampStatus {
+	c.rampMutex.Lock()
+	defer c.rampMutex.Unlock()
+	r, ok := c.ramps[side]
+	if !ok {
+		return nil
+	}
+	status := r.status
+	return &status
+}
+
+// manualOverride is called when a level is set from outside the server, any ramp on that side gives way.
+func (c *PodConnection) manualOverride(side BedSide) {
+	if c.CancelRamp(side) {
+		c.logger.Info("Ramp cancelled by manual override", zap.Int("side", int(side)))
+	}
+}
+
+func (c *PodConnection) runRamp(r *ramp) {
+	ticker := time.NewTicker(r.params.Interval)
+	defer ticker.Stop()
+	defer func() {
+		c.rampMutex.Lock()
+		if c.ramps[r.params.Side] == r {
+			delete(c.ramps, r.params.Side)
+		}
+		c.rampMutex.Unlock()
+	}()
+
+	last := r.status.Start
+	for {
+		select {
+		case <-r.cancel:
+			return
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(r.status.StartedAt)
+			finished := elapsed >= r.params.Duration
+			level := r.params.Goal
+			if !finished {
+				progress := float64(elapsed) / float64(r.params.Duration)
+				level = r.status.Start + int(float64(r.params.Goal-r.status.Start)*progress)
+			}
+			delta := level - last
+			if delta < 0 {
+				delta = -delta
+			}
+			if finished || (delta >= r.params.StepSize && level != last) {
+				written, err := c.setRampLevel(r, level)
+				if !written {
+					return
+				}
+				if err != nil {
+					c.logger.Error("Error setting ramp level", zap.Int("side", int(r.params.Side)), zap.Int("level", level), zap.Error(err))
+					continue
+				}
+				last = level
+				c.rampMutex.Lock()
+				r.status.Current = level
+				c.rampMutex.Unlock()
+			}
+			if finished {
+				c.logger.Info("Ramp finished", zap.Int("side", int(r.params.Side)), zap.Int("level", level))
+				return
+			}
+		}
+	}
+}
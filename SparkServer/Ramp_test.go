@@ -0,0 +1,68 @@
+package SparkServer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoppedRampDoesNotWrite(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	close(c.done)
+	r := &ramp{params: RampParams{Side: BedSideLeft}, cancel: make(chan struct{})}
+
+	// not stopped, so the write is attempted and fails as the pod is gone
+	written, err := c.setRampLevel(r, 3)
+	if !written || err == nil {
+		t.Fatalf("got written %t and %v, want the write attempted and failed", written, err)
+	}
+
+	r.stop()
+	written, err = c.setRampLevel(r, 3)
+	if written || err != nil {
+		t.Fatalf("got written %t and %v from a stopped ramp", written, err)
+	}
+}
+
+func TestCancelRampWaitsForWrite(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	r := &ramp{params: RampParams{Side: BedSideLeft}, cancel: make(chan struct{})}
+	c.ramps[BedSideLeft] = r
+
+	// a write in flight
+	c.rampWriteMutexes[BedSideLeft].Lock()
+	cancelled := make(chan bool)
+	go func() {
+		cancelled <- c.CancelRamp(BedSideLeft)
+	}()
+	select {
+	case <-cancelled:
+		t.Fatal("CancelRamp returned while a ramp write was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.rampWriteMutexes[BedSideLeft].Unlock()
+	if !<-cancelled {
+		t.Error("CancelRamp didn't find the ramp")
+	}
+}
+
+func TestCancelRampDoesNotWaitForTheOtherSide(t *testing.T) {
+	c := NewPodConnection(nil, nil, "")
+	r := &ramp{params: RampParams{Side: BedSideLeft}, cancel: make(chan struct{})}
+	c.ramps[BedSideLeft] = r
+
+	// a write in flight on the right
+	c.rampWriteMutexes[BedSideRight].Lock()
+	defer c.rampWriteMutexes[BedSideRight].Unlock()
+	cancelled := make(chan bool)
+	go func() {
+		cancelled <- c.CancelRamp(BedSideLeft)
+	}()
+	select {
+	case ok := <-cancelled:
+		if !ok {
+			t.Error("CancelRamp didn't find the ramp")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CancelRamp on the left waited for a write on the right")
+	}
+}
@@ -0,0 +1,322 @@
+package SparkServer
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Every write to the pod goes through SetValueFrom, which checks it against the safety config first.
+Levels and heat times are clamped into the configured per side limits, writes from locked sources are refused while
+the child lock is on, and writes from clients are refused for a side during its quiet hours.
+The server's own schedules are never locked out, but are still clamped.
+
+The max heat time caps a whole run of heating, from the write that turned a side on until it is turned off or its
+time runs out.  Writes that extend a run only get what is left of it, so a side can't be kept on by writing again.
+*/
+
+type CommandSource string
+
+const (
+	SourceServer    CommandSource = "server" // schedules, ramps, dimming
+	SourceFreeSleep CommandSource = "free-sleep"
+	SourceApi       CommandSource = "api"
+	SourceMqtt      CommandSource = "mqtt"
+)
+
+type SideLimits struct {
+	MinLevel    int    `json:"min_level"`
+	MaxLevel    int    `json:"max_level"`
+	MaxHeatTime int    `json:"max_heat_time"` // seconds a side may heat for in one run, 0 for no limit
+	QuietStart  string `json:"quiet_start,omitempty"`
+	QuietEnd    string `json:"quiet_end,omitempty"`
+}
+
+type SafetyConfig struct {
+	Left          SideLimits      `json:"left"`
+	Right         SideLimits      `json:"right"`
+	ChildLock     bool            `json:"child_lock"`
+	LockedSources []CommandSource `json:"locked_sources"`
+}
+
+// CommandRefusedError is returned when a write is refused by the safety config.
+type CommandRefusedError struct {
+	Reason string
+}
+
+func (e *CommandRefusedError) Error() string {
+	return "command refused: " + e.Reason
+}
+
+func DefaultSafetyConfig() SafetyConfig {
+	limits := SideLimits{MinLevel: MinHeatLevel, MaxLevel: MaxHeatLevel}
+	return SafetyConfig{
+		Left:          limits,
+		Right:         limits,
+		LockedSources: []CommandSource{SourceFreeSleep},
+	}
+}
+
+// LoadSafetyConfig reads a config file, anything missing keeps its default.
+func LoadSafetyConfig(path string) (SafetyConfig, error) {
+	config := DefaultSafetyConfig()
+	err := readJSONFile(path, &config)
+	if err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+func (l SideLimits) Validate() error {
+	if l.MinLevel < MinHeatLevel || l.MaxLevel > MaxHeatLevel || l.MinLevel > l.MaxLevel {
+		return Invalidf("invalid level limits %d to %d", l.MinLevel, l.MaxLevel)
+	}
+	if l.MaxHeatTime < 0 {
+		return Invalidf("invalid max heat time %d", l.MaxHeatTime)
+	}
+	if (l.QuietStart == "") != (l.QuietEnd == "") {
+		return Invalidf("quiet hours need both a start and an end")
+	}
+	if l.QuietStart != "" {
+		_, err := parseTimeOfDay(l.QuietStart)
+		if err != nil {
+			return err
+		}
+		_, err = parseTimeOfDay(l.QuietEnd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c SafetyConfig) Validate() error {
+	err := c.Left.Validate()
+	if err != nil {
+		return fmt.Errorf("left: %w", err)
+	}
+	err = c.Right.Validate()
+	if err != nil {
+		return fmt.Errorf("right: %w", err)
+	}
+	return nil
+}
+
+func (c SafetyConfig) limits(side BedSide) SideLimits {
+	if side == BedSideRight {
+		return c.Right
+	}
+	return c.Left
+}
+
+// inQuietHours reports whether t falls within the side's quiet hours, which may wrap past midnight.
+func (l SideLimits) inQuietHours(t time.Time) bool {
+	if l.QuietStart == "" {
+		return false
+	}
+	start, err := parseTimeOfDay(l.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := parseTimeOfDay(l.QuietEnd)
+	if err != nil {
+		return false
+	}
+	schedule := DimmingSchedule{NightStart: start, NightEnd: end}
+	return schedule.IsNight(t)
+}
+
+// SafetyGuard holds the active safety config, shared by every pod.
+type SafetyGuard struct {
+	path   string // where changes are saved, "" to keep them in memory only
+	config SafetyConfig
+	mutex  sync.Mutex
+}
+
+func NewSafetyGuard(config SafetyConfig) *SafetyGuard {
+	return &SafetyGuard{config: config}
+}
+
+func (g *SafetyGuard) Config() SafetyConfig {
+	if g == nil {
+		return DefaultSafetyConfig()
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.config
+}
+
+// Load reads the config from path and saves any later change back to it.  A missing file keeps the defaults.
+func (g *SafetyGuard) Load(path string) error {
+	config, err := LoadSafetyConfig(path)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.path = path
+	g.config = config
+	return nil
+}
+
+func (g *SafetyGuard) SetConfig(config SafetyConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.replaceLocked(config)
+}
+
+func (g *SafetyGuard) SetChildLock(locked bool) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	config := g.config
+	config.ChildLock = locked
+	return g.replaceLocked(config)
+}
+
+// replaceLocked saves config and only then swaps it in, so a failed write leaves memory matching the file.
+func (g *SafetyGuard) replaceLocked(config SafetyConfig) error {
+	if g.path != "" {
+		err := writeJSONFile(g.path, config)
+		if err != nil {
+			return err
+		}
+	}
+	g.config = config
+	return nil
+}
+
+// sidePaths maps the pod functions that act on a side to that side.
+var levelPaths = map[string]BedSide{"leftLevel": BedSideLeft, "rightLevel": BedSideRight}
+var heatPaths = map[string]BedSide{"leftHeat": BedSideLeft, "rightHeat": BedSideRight}
+
+// Allow refuses anything from a source that is locked out by the child lock.
+func (g *SafetyGuard) Allow(source CommandSource) error {
+	config := g.Config()
+	if !config.ChildLock {
+		return nil
+	}
+	for _, locked := range config.LockedSources {
+		if locked == source {
+			return &CommandRefusedError{Reason: "child lock is on"}
+		}
+	}
+	return nil
+}
+
+// check returns the value to send for a write, clamped if needed, or an error if the write is refused.  heated is
+// how long the side has been heating for in its current run.
+func (g *SafetyGuard) check(source CommandSource, path string, value string, now time.Time, heated time.Duration) (string, bool, error) {
+	err := g.Allow(source)
+	if err != nil {
+		return value, false, err
+	}
+	config := g.Config()
+
+	side, isLevel := levelPaths[path]
+	if !isLevel {
+		var isHeat bool
+		side, isHeat = heatPaths[path]
+		if !isHeat {
+			return value, false, nil
+		}
+	}
+	limits := config.limits(side)
+
+	if source != SourceServer && limits.inQuietHours(now) {
+		return value, false, &CommandRefusedError{Reason: "quiet hours"}
+	}
+
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		return value, false, &CommandRefusedError{Reason: fmt.Sprintf("invalid value %q", value)}
+	}
+	clamped := intValue
+	if isLevel {
+		clamped = max(limits.MinLevel, min(limits.MaxLevel, intValue))
+	} else {
+		clamped = max(0, intValue)
+		if limits.MaxHeatTime > 0 {
+			left := max(0, limits.MaxHeatTime-int(heated/time.Second))
+			clamped = min(left, clamped)
+		}
+	}
+	return strconv.Itoa(clamped), clamped != intValue, nil
+}
+
+// Allow reports whether a source may currently change anything on the pod.
+func (c *PodConnection) Allow(source CommandSource) error {
+	err := c.safety.Allow(source)
+	if err != nil {
+		c.logger.Warn("Refused pod command", zap.String("source", string(source)), zap.Error(err))
+	}
+	return err
+}
+
+// heatRun is a side's current run of heating, from the write that turned it on until it is off again.
+type heatRun struct {
+	since time.Time
+	until time.Time
+}
+
+// heatedLocked returns how long a side has been heating for in its current run, heatMutex must be held.
+func (c *PodConnection) heatedLocked(side BedSide, now time.Time) time.Duration {
+	run, ok := c.heatRuns[side]
+	if !ok || !now.Before(run.until) {
+		return 0
+	}
+	return now.Sub(run.since)
+}
+
+// recordHeatLocked notes a heat time written to a side, heatMutex must be held.
+func (c *PodConnection) recordHeatLocked(side BedSide, seconds int, now time.Time) {
+	if seconds <= 0 {
+		delete(c.heatRuns, side)
+		return
+	}
+	run, ok := c.heatRuns[side]
+	if !ok || !now.Before(run.until) {
+		run.since = now
+	}
+	run.until = now.Add(time.Duration(seconds) * time.Second)
+	c.heatRuns[side] = run
+}
+
+// SetValueFrom checks a write against the safety config and sends it to the pod.
+func (c *PodConnection) SetValueFrom(source CommandSource, path string, value string) error {
+	now := time.Now()
+	var heated time.Duration
+	side, isHeat := heatPaths[path]
+	if isHeat {
+		// held until the write is recorded, so two writes can't both be checked against the same run
+		c.heatMutex.Lock()
+		defer c.heatMutex.Unlock()
+		heated = c.heatedLocked(side, now)
+	}
+	checked, clamped, err := c.safety.check(source, path, value, now, heated)
+	if err != nil {
+		c.logger.Warn("Refused pod command", zap.String("source", string(source)), zap.String("path", path), zap.String("value", value), zap.Error(err))
+		return err
+	}
+	if clamped {
+		c.logger.Warn("Clamped pod command", zap.String("source", string(source)), zap.String("path", path), zap.String("requested", value), zap.String("value", checked))
+	}
+	err = c.callFunction(path, checked)
+	if err != nil {
+		return err
+	}
+	if isHeat {
+		seconds, _ := strconv.Atoi(checked)
+		c.recordHeatLocked(side, seconds, now)
+	}
+	c.events.Publish(Event{Type: EventCommand, DeviceId: c.DeviceId(), Time: time.Now(), Data: CommandEvent{Source: source, Path: path, Value: checked}})
+	c.refreshStatus()
+	return nil
+}
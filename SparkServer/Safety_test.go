@@ -0,0 +1,216 @@
+package SparkServer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSafetyCheckClamps(t *testing.T) {
+	config := DefaultSafetyConfig()
+	config.Left = SideLimits{MinLevel: -50, MaxLevel: 40, MaxHeatTime: 3600}
+	guard := NewSafetyGuard(config)
+	now := time.Date(2024, time.March, 12, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		path    string
+		value   string
+		heated  time.Duration
+		want    string
+		clamped bool
+	}{
+		{"level within the limits", "leftLevel", "20", 0, "20", false},
+		{"level above the max", "leftLevel", "90", 0, "40", true},
+		{"level below the min", "leftLevel", "-80", 0, "-50", true},
+		{"other side has the defaults", "rightLevel", "90", 0, "90", false},
+		{"heat time within the cap", "leftHeat", "1800", 0, "1800", false},
+		{"heat time over the cap", "leftHeat", "7200", 0, "3600", true},
+		{"negative heat time", "leftHeat", "-5", 0, "0", true},
+		{"heat time after heating a while", "leftHeat", "3600", 45 * time.Minute, "900", true},
+		{"heat time once the run used the cap", "leftHeat", "3600", 2 * time.Hour, "0", true},
+		{"turning off is never clamped", "leftHeat", "0", 2 * time.Hour, "0", false},
+		{"other paths pass through", "setsettings", "a0", 0, "a0", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, clamped, err := guard.check(SourceApi, test.path, test.value, now, test.heated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want || clamped != test.clamped {
+				t.Errorf("got %s clamped %t, want %s clamped %t", got, clamped, test.want, test.clamped)
+			}
+		})
+	}
+
+	_, _, err := guard.check(SourceApi, "leftLevel", "warm", now, 0)
+	var refused *CommandRefusedError
+	if !errors.As(err, &refused) {
+		t.Errorf("got %v for a non numeric level, want it refused", err)
+	}
+}
+
+func TestSafetyQuietHoursWrapPastMidnight(t *testing.T) {
+	config := DefaultSafetyConfig()
+	config.Left.QuietStart = "23:00"
+	config.Left.QuietEnd = "06:00"
+	guard := NewSafetyGuard(config)
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, time.March, 12, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name    string
+		source  CommandSource
+		path    string
+		now     time.Time
+		refused bool
+	}{
+		{"before quiet hours", SourceApi, "leftLevel", at(22, 59), false},
+		{"start of quiet hours", SourceApi, "leftLevel", at(23, 0), true},
+		{"past midnight", SourceFreeSleep, "leftHeat", at(0, 30), true},
+		{"end of quiet hours", SourceApi, "leftLevel", at(6, 0), false},
+		{"other side", SourceApi, "rightLevel", at(0, 30), false},
+		{"server schedules", SourceServer, "leftLevel", at(0, 30), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := guard.check(test.source, test.path, "10", test.now, 0)
+			var refused *CommandRefusedError
+			if errors.As(err, &refused) != test.refused {
+				t.Errorf("got %v, want refused %t", err, test.refused)
+			}
+		})
+	}
+}
+
+func TestSafetyChildLock(t *testing.T) {
+	config := DefaultSafetyConfig()
+	config.LockedSources = []CommandSource{SourceFreeSleep, SourceMqtt}
+	guard := NewSafetyGuard(config)
+	for _, source := range []CommandSource{SourceFreeSleep, SourceMqtt, SourceApi, SourceServer} {
+		if err := guard.Allow(source); err != nil {
+			t.Errorf("%s refused while the child lock is off: %v", source, err)
+		}
+	}
+
+	err := guard.SetChildLock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source  CommandSource
+		refused bool
+	}{
+		{SourceFreeSleep, true},
+		{SourceMqtt, true},
+		{SourceApi, false},
+		{SourceServer, false},
+	}
+	for _, test := range tests {
+		err := guard.Allow(test.source)
+		var refused *CommandRefusedError
+		if errors.As(err, &refused) != test.refused {
+			t.Errorf("%s: got %v, want refused %t", test.source, err, test.refused)
+		}
+		_, _, err = guard.check(test.source, "setsettings", "a0", time.Now(), 0)
+		if errors.As(err, &refused) != test.refused {
+			t.Errorf("%s writing settings: got %v, want refused %t", test.source, err, test.refused)
+		}
+	}
+}
+
+func TestSafetyConfigIsSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "safety.json")
+	guard := NewSafetyGuard(DefaultSafetyConfig())
+	err := guard.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := guard.Config()
+	config.Left.MaxLevel = 30
+	err = guard.SetConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = guard.SetChildLock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as after a restart
+	reloaded := NewSafetyGuard(DefaultSafetyConfig())
+	err = reloaded.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Config(); !got.ChildLock || got.Left.MaxLevel != 30 {
+		t.Fatalf("got %+v, want the child lock and max level saved", got)
+	}
+
+	// a directory where the file should be makes the save fail, which must leave the lock as it was
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.SetChildLock(false); err == nil {
+		t.Fatal("SetChildLock succeeded without saving")
+	}
+	if !reloaded.Config().ChildLock {
+		t.Error("child lock was released without being saved")
+	}
+}
+
+func TestMaxHeatTimeCapsTheRun(t *testing.T) {
+	config := DefaultSafetyConfig()
+	config.Left.MaxHeatTime = 3600
+	c := NewPodConnection(nil, nil, "")
+	c.safety = NewSafetyGuard(config)
+	writes := answerPod(t, c)
+	defer close(c.done)
+
+	err := c.SetTimeFrom(SourceApi, 3600, BedSideLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if write := nextWrite(t, writes); write != "leftHeat 3600" {
+		t.Fatalf("got %q, want the whole hour", write)
+	}
+
+	// as if that run started 50 minutes ago, writing again only gets the rest of the hour
+	c.heatMutex.Lock()
+	run := c.heatRuns[BedSideLeft]
+	run.since = run.since.Add(-50 * time.Minute)
+	c.heatRuns[BedSideLeft] = run
+	c.heatMutex.Unlock()
+	err = c.SetTimeFrom(SourceApi, 3600, BedSideLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if write := nextWrite(t, writes); write != "leftHeat 600" {
+		t.Fatalf("got %q, want what is left of the hour", write)
+	}
+
+	// turning the side off ends the run, so the next one gets the whole hour again
+	err = c.SetTimeFrom(SourceApi, 0, BedSideLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if write := nextWrite(t, writes); write != "leftHeat 0" {
+		t.Fatalf("got %q, want the side turned off", write)
+	}
+	err = c.SetTimeFrom(SourceApi, 3600, BedSideLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if write := nextWrite(t, writes); write != "leftHeat 3600" {
+		t.Fatalf("got %q, want a new run", write)
+	}
+}
@@ -7,15 +7,30 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type Server struct {
-	serverPrivateKey *rsa.PrivateKey
-	port             int
-	socketPath       string
-	logger           *zap.Logger
+	serverPrivateKey   *rsa.PrivateKey
+	port               int
+	socketPath         string
+	dimmingSchedule    *DimmingSchedule
+	dataPath           string
+	pods               map[string]*PodConnection // connected pods by device id
+	alarmSchedulers    map[string]*AlarmScheduler
+	tempSchedulers     map[string]*TemperatureScheduler
+	calibrations       map[string]*CalibrationStore
+	safety             *SafetyGuard
+	primeTime          string
+	primeSchedulers    map[string]*PrimeScheduler
+	notifiers          []Notifier
+	statusPollInterval time.Duration
+	events             *EventBus
+	mutex              sync.Mutex
+	logger             *zap.Logger
 }
 
 func NewServer(publicKeyPath string, port int, socketPath string) *Server {
@@ -37,13 +52,162 @@ func NewServer(publicKeyPath string, port int, socketPath string) *Server {
 	logger, _ := zap.NewProduction()
 
 	return &Server{
-		serverPrivateKey: cert.(*rsa.PrivateKey),
-		port:             port,
-		socketPath:       socketPath,
-		logger:           logger,
+		serverPrivateKey:   cert.(*rsa.PrivateKey),
+		port:               port,
+		socketPath:         socketPath,
+		pods:               make(map[string]*PodConnection),
+		alarmSchedulers:    make(map[string]*AlarmScheduler),
+		tempSchedulers:     make(map[string]*TemperatureScheduler),
+		calibrations:       make(map[string]*CalibrationStore),
+		safety:             NewSafetyGuard(DefaultSafetyConfig()),
+		primeSchedulers:    make(map[string]*PrimeScheduler),
+		notifiers:          []Notifier{NewLogNotifier(logger)},
+		statusPollInterval: defaultStatusPollInterval,
+		events:             NewEventBus(),
+		logger:             logger,
 	}
 }
 
+// SetDimmingSchedule enables automatic LED dimming on every pod that connects.
+func (s *Server) SetDimmingSchedule(schedule *DimmingSchedule) {
+	s.dimmingSchedule = schedule
+}
+
+// SetDataPath sets the directory where per-pod state such as recurring alarms is kept.
+func (s *Server) SetDataPath(path string) {
+	s.dataPath = path
+}
+
+// SetPrimeTime enables a daily prime at the given HH:MM.
+func (s *Server) SetPrimeTime(primeTime string) error {
+	_, err := parseTimeOfDay(primeTime)
+	if err != nil {
+		return err
+	}
+	s.primeTime = primeTime
+	return nil
+}
+
+// AddNotifier adds somewhere to send alerts to, alerts are always logged.
+func (s *Server) AddNotifier(notifier Notifier) {
+	s.notifiers = append(s.notifiers, notifier)
+}
+
+// SetStatusPollInterval sets how often each pod's status is checked for alerts, anything but a positive interval
+// keeps the default.
+func (s *Server) SetStatusPollInterval(interval time.Duration) {
+	if interval <= 0 {
+		s.logger.Warn("Invalid status poll interval, using the default", zap.Duration("interval", interval), zap.Duration("default", defaultStatusPollInterval))
+		interval = defaultStatusPollInterval
+	}
+	s.statusPollInterval = interval
+}
+
+// Events returns the bus that status changes, commands, alerts and connections are published on.
+func (s *Server) Events() *EventBus {
+	return s.events
+}
+
+// Safety returns the safety limits and child lock shared by every pod.
+func (s *Server) Safety() *SafetyGuard {
+	return s.safety
+}
+
+// GetPod returns the connected pod with the given device id.
+func (s *Server) GetPod(deviceId string) (*PodConnection, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pod, ok := s.pods[deviceId]
+	return pod, ok
+}
+
+// Pods returns all connected pods.
+func (s *Server) Pods() []*PodConnection {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pods := make([]*PodConnection, 0, len(s.pods))
+	for _, pod := range s.pods {
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+// AlarmScheduler returns the recurring alarms of a pod, loading them from disk the first time.
+func (s *Server) AlarmScheduler(deviceId string) (*AlarmScheduler, error) {
+	if !validDeviceId(deviceId) {
+		return nil, Invalidf("invalid device id %q", deviceId)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scheduler, ok := s.alarmSchedulers[deviceId]
+	if ok {
+		return scheduler, nil
+	}
+	scheduler, err := NewAlarmScheduler(deviceDataPath(s.dataPath, deviceId, "recurring_alarms.json"), s.logger.With(zap.String("device_id", deviceId)))
+	if err != nil {
+		return nil, err
+	}
+	s.alarmSchedulers[deviceId] = scheduler
+	return scheduler, nil
+}
+
+// TemperatureScheduler returns the temperature programs of a pod, loading them from disk the first time.
+func (s *Server) TemperatureScheduler(deviceId string) (*TemperatureScheduler, error) {
+	if !validDeviceId(deviceId) {
+		return nil, Invalidf("invalid device id %q", deviceId)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scheduler, ok := s.tempSchedulers[deviceId]
+	if ok {
+		return scheduler, nil
+	}
+	scheduler, err := NewTemperatureScheduler(deviceDataPath(s.dataPath, deviceId, "temperature_programs.json"), s.logger.With(zap.String("device_id", deviceId)))
+	if err != nil {
+		return nil, err
+	}
+	s.tempSchedulers[deviceId] = scheduler
+	return scheduler, nil
+}
+
+// Calibration returns the temperature calibration of a pod, loading it from disk the first time.
+func (s *Server) Calibration(deviceId string) (*CalibrationStore, error) {
+	if !validDeviceId(deviceId) {
+		return nil, Invalidf("invalid device id %q", deviceId)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	store, ok := s.calibrations[deviceId]
+	if ok {
+		return store, nil
+	}
+	store, err := NewCalibrationStore(deviceDataPath(s.dataPath, deviceId, "calibration.json"))
+	if err != nil {
+		return nil, err
+	}
+	s.calibrations[deviceId] = store
+	return store, nil
+}
+
+// PrimeScheduler returns the prime tracking of a pod, loading its history from disk the first time.
+func (s *Server) PrimeScheduler(deviceId string) (*PrimeScheduler, error) {
+	if !validDeviceId(deviceId) {
+		return nil, Invalidf("invalid device id %q", deviceId)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scheduler, ok := s.primeSchedulers[deviceId]
+	if ok {
+		return scheduler, nil
+	}
+	scheduler, err := NewPrimeScheduler(deviceDataPath(s.dataPath, deviceId, "prime_history.json"), s.primeTime, s.logger.With(zap.String("device_id", deviceId)))
+	if err != nil {
+		return nil, err
+	}
+	s.primeSchedulers[deviceId] = scheduler
+	return scheduler, nil
+}
+
 func (s *Server) StartServer() {
 	s.logger.Info("Starting SparkServer", zap.Int("port", s.port))
 	portString := fmt.Sprintf(":%d", s.port)
@@ -72,6 +236,65 @@ func (s *Server) handleConnection(c net.Conn) {
 	}(c)
 
 	client := NewPodConnection(&c, s.serverPrivateKey, s.socketPath)
+	client.dimmingSchedule = s.dimmingSchedule
+	client.safety = s.safety
+	client.events = s.events
+	client.onReady = s.podReady
 	client.HandleConnection() // blocking call
+	s.mutex.Lock()
+	wasReady := s.pods[client.DeviceId()] == client
+	if wasReady {
+		delete(s.pods, client.DeviceId())
+	}
+	s.mutex.Unlock()
+	if wasReady {
+		podConnectedGauge.WithLabelValues(client.DeviceId()).Set(0)
+		forgetStatusMetrics(client.DeviceId())
+		s.events.Publish(Event{Type: EventDisconnected, DeviceId: client.DeviceId(), Time: time.Now()})
+		s.notify(Alert{Type: AlertPodOffline, DeviceId: client.DeviceId(), Message: "pod disconnected", Time: time.Now()})
+	}
 	s.logger.Info("Client disconnected", zap.String("remote_addr", c.RemoteAddr().String()))
 }
+
+// podReady is called once a pod has said hello and can take requests.
+func (s *Server) podReady(c *PodConnection) {
+	deviceId := c.DeviceId()
+	s.mutex.Lock()
+	s.pods[deviceId] = c
+	s.mutex.Unlock()
+	s.logger.Info("Pod ready", zap.String("device_id", deviceId))
+	podConnectedGauge.WithLabelValues(deviceId).Set(1)
+	s.events.Publish(Event{Type: EventConnected, DeviceId: deviceId, Time: time.Now()})
+	s.notify(Alert{Type: AlertPodOnline, DeviceId: deviceId, Message: "pod connected", Time: time.Now()})
+
+	calibration, err := s.Calibration(deviceId)
+	if err != nil {
+		s.logger.Error("Error loading calibration", zap.String("device_id", deviceId), zap.Error(err))
+		calibration, _ = NewCalibrationStore("")
+	}
+	c.calibration = calibration
+
+	primeScheduler, err := s.PrimeScheduler(deviceId)
+	if err != nil {
+		s.logger.Error("Error loading prime history", zap.String("device_id", deviceId), zap.Error(err))
+	} else {
+		c.primer = primeScheduler
+		go primeScheduler.Run(c)
+	}
+
+	alarmScheduler, err := s.AlarmScheduler(deviceId)
+	if err != nil {
+		s.logger.Error("Error loading recurring alarms", zap.String("device_id", deviceId), zap.Error(err))
+	} else {
+		go alarmScheduler.Run(c)
+	}
+
+	temperatureScheduler, err := s.TemperatureScheduler(deviceId)
+	if err != nil {
+		s.logger.Error("Error loading temperature programs", zap.String("device_id", deviceId), zap.Error(err))
+	} else {
+		go temperatureScheduler.Run(c)
+	}
+
+	go s.monitorStatus(c)
+}
@@ -0,0 +1,26 @@
+package SparkServer
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSetStatusPollInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{30 * time.Second, 30 * time.Second},
+		{0, defaultStatusPollInterval},
+		{-time.Second, defaultStatusPollInterval},
+	}
+	for _, test := range tests {
+		s := &Server{logger: zap.NewNop()}
+		s.SetStatusPollInterval(test.interval)
+		if s.statusPollInterval != test.want {
+			t.Errorf("SetStatusPollInterval(%s) gave %s, want %s", test.interval, s.statusPollInterval, test.want)
+		}
+	}
+}
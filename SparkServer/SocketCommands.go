@@ -17,3 +17,27 @@ const (
 	FrankenCmdDeviceStatus   FrankenCommand = 14
 	FrankenCmdAlarmClear     FrankenCommand = 16
 )
+
+var frankenCommandNames = map[FrankenCommand]string{
+	FrankenCmdHello:          "hello",
+	FrankenCmdSetTemp:        "set_temp",
+	FrankenCmdSetAlarm:       "set_alarm",
+	FrankenCmdAlarmLeft:      "alarm_left",
+	FrankenCmdAlarmRight:     "alarm_right",
+	FrankenCmdSetSettings:    "set_settings",
+	FrankenCmdLeftTempDur:    "left_temp_dur",
+	FrankenCmdRightTempDur:   "right_temp_dur",
+	FrankenCmdTempLevelLeft:  "temp_level_left",
+	FrankenCmdTempLevelRight: "temp_level_right",
+	FrankenCmdPrime:          "prime",
+	FrankenCmdDeviceStatus:   "device_status",
+	FrankenCmdAlarmClear:     "alarm_clear",
+}
+
+func (f FrankenCommand) String() string {
+	name, ok := frankenCommandNames[f]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
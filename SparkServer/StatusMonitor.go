@@ -0,0 +1,90 @@
+package SparkServer
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStatusPollInterval = time.Minute
+	maxStatusAge              = 2 * time.Minute // how old a status can be to stand in for one the pod didn't answer
+)
+
+// monitorStatus polls the pod's status until it disconnects, raising alerts on anything worth knowing about and
+// publishing what changed.  Besides the poll, the status is read again after every command the pod accepts.
+func (s *Server) monitorStatus(c *PodConnection) {
+	ticker := time.NewTicker(s.statusPollInterval)
+	defer ticker.Stop()
+
+	detector := AlertDetector{}
+	for {
+		status, err := c.GetStatus()
+		if err != nil {
+			s.logger.Error("Error polling pod status", zap.String("device_id", c.DeviceId()), zap.Error(err))
+		} else {
+			now := time.Now()
+			c.recordStatus(status, now)
+			for _, alert := range detector.Detect(c.DeviceId(), status, now) {
+				s.notify(alert)
+			}
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-c.statusRefresh:
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshStatus has the status read again straight away, so what a command changed is published without waiting for
+// the next poll.  Refreshes asked for while one is pending are folded into it.
+func (c *PodConnection) refreshStatus() {
+	select {
+	case c.statusRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// LastStatus returns the most recent status seen by the status poller, nil before the first poll.
+func (c *PodConnection) LastStatus() *PodStatus {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	return c.lastStatus
+}
+
+// recentStatus returns the last status if the pod is still connected and it was read within maxStatusAge, nil
+// otherwise.
+func (c *PodConnection) recentStatus(now time.Time) *PodStatus {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	if c.lastStatus == nil || now.Sub(c.lastStatusAt) > maxStatusAge {
+		return nil
+	}
+	return c.lastStatus
+}
+
+// recordStatus stores a freshly read status and publishes what changed since the last one.
+func (c *PodConnection) recordStatus(status PodStatus, now time.Time) {
+	c.statusMutex.Lock()
+	previous := c.lastStatus
+	c.lastStatus = &status
+	c.lastStatusAt = now
+	c.statusMutex.Unlock()
+	recordStatusMetrics(c.DeviceId(), status)
+
+	if previous == nil {
+		return
+	}
+	changes := DiffStatus(*previous, status)
+	if len(changes) > 0 {
+		c.events.Publish(Event{Type: EventStatusChanged, DeviceId: c.DeviceId(), Time: now, Data: changes})
+	}
+}
@@ -0,0 +1,189 @@
+package SparkServer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+/*
+The pod works in abstract heat levels from -100 to 100.  We map them onto temperatures with the same straight line
+free-sleep uses:
+
+	°F = 82.5 + level * 0.275
+
+so -100 is 55°F (12.8°C), 0 is 82.5°F (28.1°C) and 100 is 110°F (43.3°C).
+
+The real surface temperature varies between pods and sides, so each side can carry a calibration offset measured by
+the user, added on top of the curve.  Offsets are stored in °F.
+*/
+
+const (
+	neutralFahrenheit  = 82.5
+	fahrenheitPerLevel = 0.275
+)
+
+type TemperatureUnit string
+
+const (
+	Fahrenheit TemperatureUnit = "F"
+	Celsius    TemperatureUnit = "C"
+)
+
+// Temperature is a level expressed in both units.
+type Temperature struct {
+	Fahrenheit float64 `json:"fahrenheit"`
+	Celsius    float64 `json:"celsius"`
+}
+
+func ParseTemperatureUnit(s string) (TemperatureUnit, error) {
+	switch s {
+	case "F", "f", "fahrenheit":
+		return Fahrenheit, nil
+	case "C", "c", "celsius":
+		return Celsius, nil
+	}
+	return "", Invalidf("unknown temperature unit %q, expected F or C", s)
+}
+
+func FahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+func CelsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// LevelToFahrenheit converts a level using the uncalibrated curve.
+func LevelToFahrenheit(level int) float64 {
+	return neutralFahrenheit + float64(level)*fahrenheitPerLevel
+}
+
+// FahrenheitToLevel converts a temperature to the nearest level using the uncalibrated curve, clamped to the pod's range.
+func FahrenheitToLevel(f float64) int {
+	level := int(math.Round((f - neutralFahrenheit) / fahrenheitPerLevel))
+	return max(MinHeatLevel, min(MaxHeatLevel, level))
+}
+
+func roundTenth(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// Calibration holds the per side offsets, in °F, between the curve and what the user measured.
+type Calibration struct {
+	LeftOffset  float64 `json:"left_offset_f"`
+	RightOffset float64 `json:"right_offset_f"`
+}
+
+func (cal Calibration) Offset(side BedSide) float64 {
+	if side == BedSideRight {
+		return cal.RightOffset
+	}
+	return cal.LeftOffset
+}
+
+// Temperature converts a level on a side to a calibrated temperature.
+func (cal Calibration) Temperature(level int, side BedSide) Temperature {
+	f := LevelToFahrenheit(level) + cal.Offset(side)
+	return Temperature{
+		Fahrenheit: roundTenth(f),
+		Celsius:    roundTenth(FahrenheitToCelsius(f)),
+	}
+}
+
+// Level converts a calibrated temperature on a side to the level that produces it.
+func (cal Calibration) Level(value float64, unit TemperatureUnit, side BedSide) (int, error) {
+	f := value
+	switch unit {
+	case Fahrenheit:
+	case Celsius:
+		f = CelsiusToFahrenheit(value)
+	default:
+		return 0, Invalidf("unknown temperature unit %q", unit)
+	}
+	f -= cal.Offset(side)
+	minF := LevelToFahrenheit(MinHeatLevel)
+	maxF := LevelToFahrenheit(MaxHeatLevel)
+	if f < minF || f > maxF {
+		return 0, Invalidf("temperature %.1f%s is outside what the pod can reach", value, unit)
+	}
+	return FahrenheitToLevel(f), nil
+}
+
+// CalibrationStore keeps the calibration of one pod on disk.
+type CalibrationStore struct {
+	path        string
+	calibration Calibration
+	mutex       sync.Mutex
+}
+
+func NewCalibrationStore(path string) (*CalibrationStore, error) {
+	s := &CalibrationStore{path: path}
+	if path != "" {
+		err := readJSONFile(path, &s.calibration)
+		if err != nil {
+			return nil, fmt.Errorf("loading calibration: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *CalibrationStore) Get() Calibration {
+	if s == nil {
+		return Calibration{}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calibration
+}
+
+// SetOffset stores a side's offset, in °F.
+func (s *CalibrationStore) SetOffset(side BedSide, offset float64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	calibration := s.calibration
+	if side == BedSideRight {
+		calibration.RightOffset = offset
+	} else {
+		calibration.LeftOffset = offset
+	}
+	if s.path != "" {
+		err := writeJSONFile(s.path, calibration)
+		if err != nil {
+			return err
+		}
+	}
+	s.calibration = calibration
+	return nil
+}
+
+// Calibrate works out a side's offset from a temperature the user measured while the side was at a given level.
+func (s *CalibrationStore) Calibrate(side BedSide, level int, measured float64, unit TemperatureUnit) (float64, error) {
+	if level < MinHeatLevel || level > MaxHeatLevel {
+		return 0, Invalidf("level %d out of range %d-%d", level, MinHeatLevel, MaxHeatLevel)
+	}
+	f := measured
+	switch unit {
+	case Fahrenheit:
+	case Celsius:
+		f = CelsiusToFahrenheit(measured)
+	default:
+		return 0, Invalidf("unknown temperature unit %q", unit)
+	}
+	offset := roundTenth(f - LevelToFahrenheit(level))
+	return offset, s.SetOffset(side, offset)
+}
+
+// SetTemperature sets a side's target from a temperature, taking the side's calibration into account.
+func (c *PodConnection) SetTemperature(value float64, unit TemperatureUnit, side BedSide) error {
+	level, err := c.calibration.Get().Level(value, unit, side)
+	if err != nil {
+		return err
+	}
+	return c.SetLevel(level, side)
+}
+
+// Calibration returns the calibration store of this pod.
+func (c *PodConnection) Calibration() *CalibrationStore {
+	return c.calibration
+}
@@ -0,0 +1,159 @@
+package SparkServer
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestLevelFahrenheitCurve(t *testing.T) {
+	tests := []struct {
+		level int
+		f     float64
+	}{
+		{MinHeatLevel, 55},
+		{-50, 68.75},
+		{0, 82.5},
+		{50, 96.25},
+		{MaxHeatLevel, 110},
+	}
+	for _, test := range tests {
+		if got := LevelToFahrenheit(test.level); math.Abs(got-test.f) > 1e-9 {
+			t.Errorf("LevelToFahrenheit(%d) = %v, want %v", test.level, got, test.f)
+		}
+		if got := FahrenheitToLevel(test.f); got != test.level {
+			t.Errorf("FahrenheitToLevel(%v) = %d, want %d", test.f, got, test.level)
+		}
+	}
+}
+
+func TestFahrenheitToLevelRoundsAndClamps(t *testing.T) {
+	tests := []struct {
+		f     float64
+		level int
+	}{
+		{83, 2},
+		{82.6, 0},
+		{82.4, 0},
+		{50, MinHeatLevel},
+		{120, MaxHeatLevel},
+	}
+	for _, test := range tests {
+		if got := FahrenheitToLevel(test.f); got != test.level {
+			t.Errorf("FahrenheitToLevel(%v) = %d, want %d", test.f, got, test.level)
+		}
+	}
+}
+
+func TestCalibrationTemperature(t *testing.T) {
+	cal := Calibration{LeftOffset: 2, RightOffset: -1.5}
+	tests := []struct {
+		level int
+		side  BedSide
+		want  Temperature
+	}{
+		{0, BedSideLeft, Temperature{Fahrenheit: 84.5, Celsius: 29.2}},
+		{0, BedSideRight, Temperature{Fahrenheit: 81, Celsius: 27.2}},
+		{MinHeatLevel, BedSideLeft, Temperature{Fahrenheit: 57, Celsius: 13.9}},
+		{MaxHeatLevel, BedSideRight, Temperature{Fahrenheit: 108.5, Celsius: 42.5}},
+	}
+	for _, test := range tests {
+		if got := cal.Temperature(test.level, test.side); got != test.want {
+			t.Errorf("Temperature(%d, %d) = %+v, want %+v", test.level, test.side, got, test.want)
+		}
+	}
+}
+
+func TestCalibrationLevel(t *testing.T) {
+	cal := Calibration{RightOffset: -2}
+	tests := []struct {
+		name  string
+		value float64
+		unit  TemperatureUnit
+		side  BedSide
+		level int
+		valid bool
+	}{
+		{"fahrenheit", 82.5, Fahrenheit, BedSideLeft, 0, true},
+		{"celsius", 20, Celsius, BedSideLeft, -53, true},
+		{"coldest in celsius", 12.8, Celsius, BedSideLeft, MinHeatLevel, true},
+		{"hottest in celsius", 43.3, Celsius, BedSideLeft, MaxHeatLevel, true},
+		{"offset applied", 80.5, Fahrenheit, BedSideRight, 0, true},
+		{"too cold", 54, Fahrenheit, BedSideLeft, 0, false},
+		{"too hot in celsius", 50, Celsius, BedSideLeft, 0, false},
+		{"out of reach once calibrated", 109, Fahrenheit, BedSideRight, 0, false},
+		{"unknown unit", 300, TemperatureUnit("K"), BedSideLeft, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			level, err := cal.Level(test.value, test.unit, test.side)
+			if !test.valid {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) {
+					t.Fatalf("got level %d and %v, want a validation error", level, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level != test.level {
+				t.Errorf("got level %d, want %d", level, test.level)
+			}
+		})
+	}
+}
+
+func TestCalibrateRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		side     BedSide
+		level    int
+		measured float64
+		unit     TemperatureUnit
+		offset   float64
+	}{
+		{"fahrenheit", BedSideLeft, 20, 90, Fahrenheit, 2},
+		{"celsius", BedSideRight, -50, 20, Celsius, -0.8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := NewCalibrationStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset, err := store.Calibrate(test.side, test.level, test.measured, test.unit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != test.offset || store.Get().Offset(test.side) != test.offset {
+				t.Fatalf("got offset %v, stored %v, want %v", offset, store.Get().Offset(test.side), test.offset)
+			}
+			// the measured temperature now asks for the level it was measured at
+			level, err := store.Get().Level(test.measured, test.unit, test.side)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level != test.level {
+				t.Errorf("got level %d, want %d", level, test.level)
+			}
+		})
+	}
+}
+
+func TestCalibrateRejectsLevelsOutOfRange(t *testing.T) {
+	store, err := NewCalibrationStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []int{MinHeatLevel - 1, MaxHeatLevel + 1} {
+		_, err := store.Calibrate(BedSideLeft, level, 80, Fahrenheit)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("level %d: got %v, want a validation error", level, err)
+		}
+	}
+	if offset := store.Get().LeftOffset; offset != 0 {
+		t.Errorf("got offset %v stored from a rejected calibration", offset)
+	}
+}
@@ -0,0 +1,344 @@
+package SparkServer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+A temperature program describes one night for one side: a bedtime level, any number of phase changes through the
+night, an optional wake level and the time heating turns off.  Times are wall clock times in the program's timezone,
+and anything earlier than the step before it is taken to be on the next day, so a night can run past midnight.
+
+The scheduler only writes to the pod when the active step changes, so manual changes in between are left alone.
+After a restart it works out the active step from the clock and picks up from there.
+*/
+
+const (
+	MinHeatLevel = -100
+	MaxHeatLevel = 100
+)
+
+var ErrProgramNotFound = errors.New("temperature program not found")
+
+type TemperaturePhase struct {
+	Time  string `json:"time"` // HH:MM
+	Level int    `json:"level"`
+}
+
+type TemperatureProgram struct {
+	Id           string             `json:"id"`
+	Side         BedSide            `json:"side"`
+	Days         []time.Weekday     `json:"days"` // days the night starts on, 0 = sunday
+	Timezone     string             `json:"timezone"`
+	Bedtime      string             `json:"bedtime"`
+	BedtimeLevel int                `json:"bedtime_level"`
+	Phases       []TemperaturePhase `json:"phases"`
+	WakeTime     string             `json:"wake_time,omitempty"`
+	WakeLevel    int                `json:"wake_level"`
+	OffTime      string             `json:"off_time"`
+	RampMinutes  int                `json:"ramp_minutes,omitempty"` // ramp into each step rather than jumping
+	Enabled      bool               `json:"enabled"`
+}
+
+// ProgramStepStatus is the step a side is currently running, reported in the pod status.
+type ProgramStepStatus struct {
+	ProgramId string    `json:"program_id"`
+	Step      int       `json:"step"`
+	Name      string    `json:"name"`
+	Level     int       `json:"level"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	OffAt     time.Time `json:"off_at"`
+
+	rampDuration time.Duration
+}
+
+// steps returns bedtime, phases and wake as a single list.
+func (p TemperatureProgram) steps() []TemperaturePhase {
+	steps := []TemperaturePhase{{Time: p.Bedtime, Level: p.BedtimeLevel}}
+	steps = append(steps, p.Phases...)
+	if p.WakeTime != "" {
+		steps = append(steps, TemperaturePhase{Time: p.WakeTime, Level: p.WakeLevel})
+	}
+	return steps
+}
+
+func stepName(p TemperatureProgram, index int) string {
+	switch {
+	case index == 0:
+		return "bedtime"
+	case p.WakeTime != "" && index == len(p.Phases)+1:
+		return "wake"
+	default:
+		return fmt.Sprintf("phase %d", index)
+	}
+}
+
+func (p TemperatureProgram) Validate() error {
+	if p.Side != BedSideLeft && p.Side != BedSideRight {
+		return Invalidf("invalid side %d", p.Side)
+	}
+	err := validateWeekdays(p.Days)
+	if err != nil {
+		return err
+	}
+	_, err = loadLocation(p.Timezone)
+	if err != nil {
+		return Invalidf("invalid timezone %q: %w", p.Timezone, err)
+	}
+	for _, step := range p.steps() {
+		_, err := parseTimeOfDay(step.Time)
+		if err != nil {
+			return err
+		}
+		if step.Level < MinHeatLevel || step.Level > MaxHeatLevel {
+			return Invalidf("level %d out of range %d-%d", step.Level, MinHeatLevel, MaxHeatLevel)
+		}
+	}
+	_, err = parseTimeOfDay(p.OffTime)
+	if err != nil {
+		return err
+	}
+	if p.RampMinutes < 0 {
+		return Invalidf("ramp minutes can't be negative")
+	}
+	return nil
+}
+
+// night returns the step start times and off time of the night starting on the given date.
+func (p TemperatureProgram) night(year int, month time.Month, day int, loc *time.Location) ([]time.Time, time.Time, error) {
+	var times []time.Time
+	previous := time.Duration(-1)
+	dayOffset := 0
+	for _, step := range p.steps() {
+		timeOfDay, err := parseTimeOfDay(step.Time)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if timeOfDay <= previous {
+			dayOffset++
+		}
+		previous = timeOfDay
+		times = append(times, wallClock(year, month, day+dayOffset, timeOfDay, loc))
+	}
+	offTime, err := parseTimeOfDay(p.OffTime)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if offTime <= previous {
+		dayOffset++
+	}
+	return times, wallClock(year, month, day+dayOffset, offTime, loc), nil
+}
+
+// ActiveStep returns the step running at now, if any.
+func (p TemperatureProgram) ActiveStep(now time.Time) (*ProgramStepStatus, error) {
+	loc, err := loadLocation(p.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	local := now.In(loc)
+	// a night that started yesterday may still be running
+	for _, dayOffset := range []int{0, -1} {
+		date := time.Date(local.Year(), local.Month(), local.Day()+dayOffset, 12, 0, 0, 0, loc)
+		if !containsWeekday(p.Days, date.Weekday()) {
+			continue
+		}
+		times, off, err := p.night(date.Year(), date.Month(), date.Day(), loc)
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(times[0]) || !now.Before(off) {
+			continue
+		}
+		steps := p.steps()
+		index := 0
+		for i := range times {
+			if !now.Before(times[i]) {
+				index = i
+			}
+		}
+		until := off
+		if index+1 < len(times) {
+			until = times[index+1]
+		}
+		return &ProgramStepStatus{
+			ProgramId: p.Id,
+			Step:      index,
+			Name:      stepName(p, index),
+			Level:     steps[index].Level,
+			Since:     times[index],
+			Until:     until,
+			OffAt:     off,
+
+			rampDuration: time.Duration(p.RampMinutes) * time.Minute,
+		}, nil
+	}
+	return nil, nil
+}
+
+// TemperatureScheduler owns the temperature programs of one pod.
+type TemperatureScheduler struct {
+	path     string
+	programs []TemperatureProgram
+	mutex    sync.Mutex
+	changed  chan struct{}
+	logger   *zap.Logger
+}
+
+func NewTemperatureScheduler(path string, logger *zap.Logger) (*TemperatureScheduler, error) {
+	s := &TemperatureScheduler{
+		path:    path,
+		changed: make(chan struct{}, 1),
+		logger:  logger,
+	}
+	if path != "" {
+		err := readJSONFile(path, &s.programs)
+		if err != nil {
+			return nil, fmt.Errorf("loading temperature programs: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *TemperatureScheduler) List() []TemperatureProgram {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]TemperatureProgram(nil), s.programs...)
+}
+
+// Add stores a new program, assigning it an id.
+func (s *TemperatureScheduler) Add(program TemperatureProgram) (TemperatureProgram, error) {
+	err := program.Validate()
+	if err != nil {
+		return program, err
+	}
+	program.Id, err = newId()
+	if err != nil {
+		return program, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	programs := append(append([]TemperatureProgram(nil), s.programs...), program)
+	return program, s.replaceLocked(programs)
+}
+
+func (s *TemperatureScheduler) Update(program TemperatureProgram) error {
+	err := program.Validate()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.programs {
+		if s.programs[i].Id == program.Id {
+			programs := append([]TemperatureProgram(nil), s.programs...)
+			programs[i] = program
+			return s.replaceLocked(programs)
+		}
+	}
+	return ErrProgramNotFound
+}
+
+func (s *TemperatureScheduler) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.programs {
+		if s.programs[i].Id == id {
+			programs := append(append([]TemperatureProgram(nil), s.programs[:i]...), s.programs[i+1:]...)
+			return s.replaceLocked(programs)
+		}
+	}
+	return ErrProgramNotFound
+}
+
+// replaceLocked saves programs and only then swaps them in, so a failed write leaves memory matching the file.
+func (s *TemperatureScheduler) replaceLocked(programs []TemperatureProgram) error {
+	if s.path != "" {
+		err := writeJSONFile(s.path, programs)
+		if err != nil {
+			return err
+		}
+	}
+	s.programs = programs
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Active returns the step running for a side, the first enabled program wins if several overlap.
+func (s *TemperatureScheduler) Active(side BedSide, now time.Time) *ProgramStepStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, program := range s.programs {
+		if !program.Enabled || program.Side != side {
+			continue
+		}
+		step, err := program.ActiveStep(now)
+		if err != nil {
+			s.logger.Error("Error computing active program step", zap.String("id", program.Id), zap.Error(err))
+			continue
+		}
+		if step != nil {
+			return step
+		}
+	}
+	return nil
+}
+
+// Run drives the pod through the active programs until the pod disconnects.
+func (s *TemperatureScheduler) Run(c *PodConnection) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	applied := map[BedSide]*ProgramStepStatus{}
+	for {
+		now := time.Now()
+		for _, side := range []BedSide{BedSideLeft, BedSideRight} {
+			step := s.Active(side, now)
+			previous := applied[side]
+			switch {
+			case step != nil && (previous == nil || previous.ProgramId != step.ProgramId || !previous.Since.Equal(step.Since)):
+				err := c.SetTime(int(step.OffAt.Sub(now).Seconds()), side)
+				if err == nil && step.rampDuration > 0 {
+					_, err = c.StartRamp(RampParams{Side: side, Goal: step.Level, Duration: step.rampDuration})
+				} else if err == nil {
+					c.CancelRamp(side)
+					err = c.SetLevel(step.Level, side)
+				}
+				if err != nil {
+					s.logger.Error("Error applying program step", zap.Int("side", int(side)), zap.String("step", step.Name), zap.Error(err))
+					continue
+				}
+				s.logger.Info("Applied program step", zap.Int("side", int(side)), zap.String("program_id", step.ProgramId), zap.String("step", step.Name), zap.Int("level", step.Level))
+				applied[side] = step
+				c.setProgramStep(side, step)
+			case step == nil && previous != nil:
+				c.CancelRamp(side)
+				err := c.SetTime(0, side)
+				if err != nil {
+					s.logger.Error("Error turning off side at end of program", zap.Int("side", int(side)), zap.Error(err))
+					continue
+				}
+				s.logger.Info("Program finished", zap.Int("side", int(side)), zap.String("program_id", previous.ProgramId))
+				delete(applied, side)
+				c.setProgramStep(side, nil)
+			}
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-s.changed:
+		case <-ticker.C:
+		}
+	}
+}
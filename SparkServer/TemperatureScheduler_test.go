@@ -0,0 +1,225 @@
+package SparkServer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"go.uber.org/zap"
+)
+
+// answerPod acks every request sent to c as the pod would, passing on each write as "path value".
+func answerPod(t *testing.T, c *PodConnection) <-chan string {
+	t.Helper()
+	writes := make(chan string, 100)
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case req := <-c.RequestPipe:
+				var paths []string
+				var query string
+				for _, option := range req.message.Options {
+					switch option.ID {
+					case message.URIPath:
+						paths = append(paths, string(option.Value))
+					case message.URIQuery:
+						query = string(option.Value)
+					}
+				}
+				if len(paths) == 2 && paths[0] == "f" {
+					writes <- paths[1] + " " + query
+				}
+				req.SetResponse(nil)
+			}
+		}
+	}()
+	return writes
+}
+
+func nextWrite(t *testing.T, writes <-chan string) string {
+	t.Helper()
+	select {
+	case write := <-writes:
+		return write
+	case <-time.After(time.Second):
+		t.Fatal("nothing was written to the pod")
+		return ""
+	}
+}
+
+func TestTemperatureProgramActiveStep(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	at := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, location)
+	}
+	// the night of monday the 11th of march, past midnight
+	night := TemperatureProgram{
+		Id: "night", Side: BedSideLeft, Days: []time.Weekday{time.Monday}, Timezone: "America/New_York",
+		Bedtime: "22:00", BedtimeLevel: 10,
+		Phases:   []TemperaturePhase{{Time: "02:00", Level: -20}},
+		WakeTime: "06:30", WakeLevel: 30,
+		OffTime: "07:00",
+	}
+	// a phase at the bedtime's time of day is the next day
+	sameTime := TemperatureProgram{
+		Id: "same", Side: BedSideLeft, Days: []time.Weekday{time.Monday}, Timezone: "America/New_York",
+		Bedtime: "22:00", BedtimeLevel: 10,
+		Phases:  []TemperaturePhase{{Time: "22:00", Level: 5}},
+		OffTime: "23:00",
+	}
+	// the nights the clocks change, with a phase in the skipped and the repeated hour
+	springForward := TemperatureProgram{
+		Id: "spring", Side: BedSideLeft, Days: []time.Weekday{time.Saturday}, Timezone: "America/New_York",
+		Bedtime: "23:00", BedtimeLevel: 10,
+		Phases:  []TemperaturePhase{{Time: "02:30", Level: -10}},
+		OffTime: "07:00",
+	}
+	fallBack := springForward
+	fallBack.Phases = []TemperaturePhase{{Time: "01:30", Level: -10}}
+
+	tests := []struct {
+		name    string
+		program TemperatureProgram
+		now     time.Time
+		step    int // -1 for no active step
+		since   time.Time
+		until   time.Time
+	}{
+		{"before bedtime", night, at(time.March, 11, 21, 59), -1, time.Time{}, time.Time{}},
+		{"bedtime", night, at(time.March, 11, 22, 0), 0, at(time.March, 11, 22, 0), at(time.March, 12, 2, 0)},
+		{"phase past midnight started yesterday", night, at(time.March, 12, 3, 0), 1, at(time.March, 12, 2, 0), at(time.March, 12, 6, 30)},
+		{"wake", night, at(time.March, 12, 6, 45), 2, at(time.March, 12, 6, 30), at(time.March, 12, 7, 0)},
+		{"off", night, at(time.March, 12, 7, 0), -1, time.Time{}, time.Time{}},
+		{"not a program day", night, at(time.March, 12, 23, 0), -1, time.Time{}, time.Time{}},
+		{"equal time still on the first day", sameTime, at(time.March, 12, 12, 0), 0, at(time.March, 11, 22, 0), at(time.March, 12, 22, 0)},
+		{"equal time rolls to the next day", sameTime, at(time.March, 12, 22, 30), 1, at(time.March, 12, 22, 0), at(time.March, 12, 23, 0)},
+		{"before a phase skipped by spring forward", springForward, at(time.March, 10, 3, 15), 0, at(time.March, 9, 23, 0), at(time.March, 10, 3, 30)},
+		{"phase skipped by spring forward runs after the gap", springForward, at(time.March, 10, 3, 30), 1, at(time.March, 10, 3, 30), at(time.March, 10, 7, 0)},
+		{"phase in the hour fall back repeats", fallBack, at(time.November, 3, 1, 45), 1, at(time.November, 3, 1, 30), at(time.November, 3, 7, 0)},
+		{"fall back night ends on the wall clock", fallBack, at(time.November, 3, 7, 0), -1, time.Time{}, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, err := test.program.ActiveStep(test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.step < 0 {
+				if step != nil {
+					t.Fatalf("got step %d (%s), want none", step.Step, step.Name)
+				}
+				return
+			}
+			if step == nil {
+				t.Fatalf("got no step, want %d", test.step)
+			}
+			if step.Step != test.step || !step.Since.Equal(test.since) || !step.Until.Equal(test.until) {
+				t.Errorf("got step %d from %s until %s, want %d from %s until %s",
+					step.Step, step.Since.In(location), step.Until.In(location), test.step, test.since, test.until)
+			}
+		})
+	}
+}
+
+func TestTemperatureSchedulerResumesAfterRestart(t *testing.T) {
+	now := time.Now().UTC()
+	program := TemperatureProgram{
+		Side: BedSideLeft, Timezone: "UTC", Enabled: true,
+		Days:         []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+		Bedtime:      now.Add(-time.Hour).Format("15:04"),
+		BedtimeLevel: 25,
+		OffTime:      now.Add(2 * time.Hour).Format("15:04"),
+	}
+	path := filepath.Join(t.TempDir(), "programs.json")
+	s, err := NewTemperatureScheduler(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err = s.Add(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new scheduler from the saved programs, as after a restart half way through the night
+	s, err = NewTemperatureScheduler(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewPodConnection(nil, nil, "")
+	writes := answerPod(t, c)
+	finished := make(chan struct{})
+	go func() {
+		s.Run(c)
+		close(finished)
+	}()
+	defer func() {
+		close(c.done)
+		<-finished
+	}()
+
+	var seconds int
+	heat := nextWrite(t, writes)
+	_, err = fmt.Sscanf(heat, "leftHeat %d", &seconds)
+	if err != nil || seconds <= 3600 || seconds > 7200 {
+		t.Fatalf("got %q, want the left side heating until the off time", heat)
+	}
+	if level := nextWrite(t, writes); level != "leftLevel 25" {
+		t.Fatalf("got %q, want the bedtime level", level)
+	}
+	// the step is recorded once the level's write returns
+	step := c.ProgramStep(BedSideLeft)
+	for deadline := time.Now().Add(time.Second); step == nil && time.Now().Before(deadline); step = c.ProgramStep(BedSideLeft) {
+		time.Sleep(time.Millisecond)
+	}
+	if step == nil || step.ProgramId != program.Id || step.Name != "bedtime" {
+		t.Fatalf("got step %+v, want the program's bedtime", step)
+	}
+}
+
+func TestTemperatureSchedulerKeepsMemoryWhenSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewTemperatureScheduler(filepath.Join(dir, "programs.json"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := TemperatureProgram{Side: BedSideLeft, Days: []time.Weekday{time.Monday}, Bedtime: "22:00", OffTime: "07:00"}
+	program, err = s.Add(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file where the directory should be makes every save fail
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dir, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Add(program); err == nil {
+		t.Fatal("Add succeeded without saving")
+	}
+	changed := program
+	changed.Bedtime = "23:00"
+	if err := s.Update(changed); err == nil {
+		t.Fatal("Update succeeded without saving")
+	}
+	if err := s.Remove(program.Id); err == nil {
+		t.Fatal("Remove succeeded without saving")
+	}
+
+	programs := s.List()
+	if len(programs) != 1 || programs[0].Id != program.Id || programs[0].Bedtime != "22:00" {
+		t.Fatalf("got %+v, want only %+v", programs, program)
+	}
+}
@@ -0,0 +1,23 @@
+package SparkServer
+
+import (
+	"fmt"
+)
+
+// ValidationError is returned for a value that is refused before anything is sent to the pod.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Invalidf formats a ValidationError.
+func Invalidf(format string, args ...interface{}) error {
+	return &ValidationError{Err: fmt.Errorf(format, args...)}
+}
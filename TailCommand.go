@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"EightSleepServer/LogServer"
+)
+
+/*
+`EightSleepServer tail` follows the firmware log of a running server through its http api, e.g.
+
+	EightSleepServer tail -contains heater
+*/
+
+func runTail(args []string) int {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	server := flags.String("url", "http://localhost:8080", "api server to follow")
+	device := flags.String("device", "", "only show this pod")
+	contains := flags.String("contains", "", "only show messages containing this")
+	_ = flags.Parse(args)
+
+	query := url.Values{}
+	if *device != "" {
+		query.Set("device", *device)
+	}
+	if *contains != "" {
+		query.Set("contains", *contains)
+	}
+	tailUrl := strings.TrimSuffix(*server, "/") + "/api/logs/tail?" + query.Encode()
+
+	for {
+		err := followTail(tailUrl)
+		fmt.Fprintf(os.Stderr, "tail: %s, reconnecting in 5 seconds\n", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// followTail prints log lines from the server-sent events stream until it ends.
+func followTail(tailUrl string) error {
+	response, err := http.Get(tailUrl)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return fmt.Errorf("%s: %s", response.Status, body.Error)
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var line LogServer.LogLine
+		err := json.Unmarshal([]byte(data), &line)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%s %s %s\n", line.Time.Local().Format(time.DateTime), line.DeviceId, line.Message)
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	return fmt.Errorf("stream closed")
+}
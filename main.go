@@ -1,15 +1,23 @@
 package main
 
 import (
+	"EightSleepServer/ApiServer"
 	"EightSleepServer/LogServer"
+	"EightSleepServer/MqttBridge"
 	"EightSleepServer/SparkServer"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		os.Exit(runTail(os.Args[2:]))
+	}
+
 	logger, _ := zap.NewProduction()
 	logger.Info("Starting server...")
 	// start the logging server
@@ -33,6 +41,29 @@ func main() {
 		logSaveBool = true
 	}
 
+	logTail := LogServer.NewLogTail()
+	logServer.AddSink(logTail)
+
+	retention := LogServer.RetentionPolicy{
+		MaxAge:       time.Duration(envInt(logger, "LOG_MAX_AGE_DAYS", 0)) * 24 * time.Hour,
+		MaxTotalSize: int64(envInt(logger, "LOG_MAX_SIZE_MB", 0)) * 1024 * 1024,
+		MaxFiles:     envInt(logger, "LOG_MAX_FILES", 0),
+		Compress:     os.Getenv("LOG_COMPRESS") == "true",
+		MinFreeBytes: uint64(envInt(logger, "LOG_MIN_FREE_MB", 500)) * 1024 * 1024,
+	}
+	logServer.SetRetention(retention)
+
+	logIndexPath := os.Getenv("LOG_INDEX_PATH")
+	if logIndexPath == "" {
+		logIndexPath = logPath + "/batches.jsonl"
+	}
+	logServer.SetIndexLimits(envInt(logger, "LOG_INDEX_ENTRIES", 10000), int64(envInt(logger, "LOG_INDEX_SIZE_MB", 10))*1024*1024)
+	err = logServer.SetIndexPath(logIndexPath)
+	if err != nil {
+		// the index is only bookkeeping, not worth stopping the pod's logs over
+		logger.Error("Can't open LOG_INDEX_PATH, batches won't be indexed", zap.String("LOG_INDEX_PATH", logIndexPath), zap.Error(err))
+	}
+	logServer.SetMaxBufferSize(envInt(logger, "LOG_BUFFER_SIZE", 4*1024*1024))
 	go logServer.StartServer(logSaveBool, logPath, logPortInt)
 
 	keyPath := os.Getenv("KEY_PATH")
@@ -54,8 +85,96 @@ func main() {
 		keyPath,
 		sparkPortInt,
 		socketPath)
+
+	dataPath := os.Getenv("DATA_PATH")
+	if dataPath == "" {
+		dataPath = "./data"
+	}
+	server.SetDataPath(dataPath)
+
+	primeTime := os.Getenv("PRIME_TIME")
+	if primeTime != "" {
+		err := server.SetPrimeTime(primeTime)
+		if err != nil {
+			logger.Panic("Invalid PRIME_TIME", zap.String("PRIME_TIME", primeTime), zap.Error(err))
+		}
+	}
+
+	alertWebhook := os.Getenv("ALERT_WEBHOOK_URL")
+	if alertWebhook != "" {
+		server.AddNotifier(SparkServer.NewWebhookNotifier(alertWebhook))
+	}
+	alertCommand := os.Getenv("ALERT_COMMAND")
+	if alertCommand != "" {
+		server.AddNotifier(SparkServer.NewCommandNotifier(alertCommand))
+	}
+	server.SetStatusPollInterval(time.Duration(envInt(logger, "STATUS_POLL_SECONDS", 60)) * time.Second)
+
+	safetyConfigPath := os.Getenv("SAFETY_CONFIG")
+	if safetyConfigPath == "" {
+		safetyConfigPath = filepath.Join(dataPath, "safety.json")
+	}
+	err = server.Safety().Load(safetyConfigPath)
+	if err != nil {
+		logger.Panic("Invalid SAFETY_CONFIG", zap.String("SAFETY_CONFIG", safetyConfigPath), zap.Error(err))
+	}
+
+	ledNightStart := os.Getenv("LED_NIGHT_START")
+	if ledNightStart != "" {
+		ledNightEnd := os.Getenv("LED_NIGHT_END")
+		if ledNightEnd == "" {
+			ledNightEnd = "07:00"
+		}
+		ledNightBrightness := envInt(logger, "LED_NIGHT_BRIGHTNESS", 0)
+		ledDayBrightness := envInt(logger, "LED_DAY_BRIGHTNESS", 100)
+		schedule, err := SparkServer.ParseDimmingSchedule(ledNightStart, ledNightEnd, ledNightBrightness, ledDayBrightness)
+		if err != nil {
+			logger.Panic("Invalid LED dimming schedule", zap.Error(err))
+		}
+		server.SetDimmingSchedule(schedule)
+	}
+
 	go server.StartServer()
 
+	apiPort := envInt(logger, "API_PORT", 8080)
+	if apiPort != 0 {
+		apiServer := ApiServer.NewApiServer(server, apiPort)
+		apiServer.SetToken(os.Getenv("API_TOKEN"))
+		apiServer.SetLogServer(&logServer)
+		apiServer.SetLogTail(logTail)
+		go apiServer.StartServer()
+	}
+
+	metricsPort := envInt(logger, "METRICS_PORT", 0)
+	if metricsPort != 0 {
+		go ApiServer.NewMetricsServer(metricsPort).StartServer()
+	}
+
+	mqttBroker := os.Getenv("MQTT_BROKER")
+	if mqttBroker != "" {
+		bridge := MqttBridge.NewBridge(server, MqttBridge.Config{
+			Broker:          mqttBroker,
+			Username:        os.Getenv("MQTT_USERNAME"),
+			Password:        os.Getenv("MQTT_PASSWORD"),
+			TopicPrefix:     os.Getenv("MQTT_TOPIC_PREFIX"),
+			DiscoveryPrefix: os.Getenv("MQTT_DISCOVERY_PREFIX"),
+			HeatTime:        envInt(logger, "MQTT_HEAT_TIME", 8*60*60),
+		})
+		go bridge.StartBridge()
+	}
+
 	// block forever
 	select {}
 }
+
+func envInt(logger *zap.Logger, name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Panic("Invalid "+name, zap.String(name, value), zap.Error(err))
+	}
+	return intValue
+}